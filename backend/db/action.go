@@ -0,0 +1,68 @@
+package db
+
+import (
+	"encoding/json"
+	"log"
+	"maps"
+
+	"flowey/timer"
+)
+
+// ApplyAction runs a timer action that happened at the given time, in
+// milliseconds since the Unix epoch, against the stored state. Fields the
+// timer doesn't know about are kept as they are.
+func ApplyAction(key StateKey, origin string, action timer.Action, at int64) (push bool, stateString string, revision Revision, err error) {
+	serverStateString, serverRevision, err := GetStateRevision(key)
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	fields, _, err := parseFields(serverStateString)
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	current := timer.New(at)
+	if serverStateString != "" {
+		if err := json.Unmarshal([]byte(serverStateString), &current); err != nil {
+			return false, "", 0, InvalidState
+		}
+	}
+	if current.Buff < timer.MinBuff {
+		return false, "", 0, InvalidState
+	}
+
+	next, err := current.Apply(action, at)
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	if next == current && serverStateString != "" {
+		return false, serverStateString, serverRevision, nil
+	}
+
+	timerBytes, err := json.Marshal(next)
+	if err != nil {
+		log.Printf("failed to marshal the timer: %v", err)
+		return false, "", 0, InternalServerError
+	}
+
+	var timerFields map[string]json.RawMessage
+	if err := json.Unmarshal(timerBytes, &timerFields); err != nil {
+		log.Printf("failed to unmarshal the timer: %v", err)
+		return false, "", 0, InternalServerError
+	}
+	maps.Copy(fields, timerFields)
+
+	newStateString, err := encodeFields(fields, nil)
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	_, stateString, revision, err = writeState(key, serverRevision, serverStateString, newStateString, change{origin: origin})
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	return true, stateString, revision, nil
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	NoSuchCalendarFeed  = errors.New("no such calendar feed")
+	InvalidCalendarFeed = errors.New("invalid calendar feed")
+)
+
+const (
+	maxCalendarFeeds           = 16
+	maxCalendarFeedLabelLength = 256
+
+	// calendarFeedHistory is how far back a calendar feed goes.
+	calendarFeedHistory = 366 * 24 * time.Hour
+	// calendarRefreshInterval is how often calendar apps are asked to poll.
+	calendarRefreshInterval = "PT15M"
+	// maxICalendarLineLength is the length in bytes lines are folded at.
+	maxICalendarLineLength = 75
+)
+
+type CalendarFeedID = int64
+
+// CalendarFeed publishes the completed focus runs of a user to anyone holding
+// its token, until it's revoked.
+type CalendarFeed struct {
+	ID        CalendarFeedID `json:"id"`
+	Token     string         `json:"token"`
+	UserID    UserID         `json:"-"`
+	Label     string         `json:"label"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+const calendarFeedQuery = `SELECT id, token, user_id, label, created_at FROM calendar_feeds`
+
+func scanCalendarFeed(scanner interface{ Scan(...any) error }) (CalendarFeed, error) {
+	var feed CalendarFeed
+	var createdAt int64
+
+	if err := scanner.Scan(&feed.ID, &feed.Token, &feed.UserID, &feed.Label, &createdAt); err != nil {
+		return CalendarFeed{}, err
+	}
+
+	feed.CreatedAt = time.UnixMilli(createdAt).UTC()
+	return feed, nil
+}
+
+// CreateCalendarFeed mints a calendar feed token for the user.
+func CreateCalendarFeed(userID UserID, label string) (CalendarFeed, error) {
+	if len(label) > maxCalendarFeedLabelLength {
+		return CalendarFeed{}, fmt.Errorf("%w: the label is longer than %d bytes", InvalidCalendarFeed, maxCalendarFeedLabelLength)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM calendar_feeds WHERE user_id = ?`, userID).Scan(&count); err != nil {
+		log.Println(err)
+		return CalendarFeed{}, InternalServerError
+	}
+	if count >= maxCalendarFeeds {
+		return CalendarFeed{}, fmt.Errorf("%w: a user can have at most %d calendar feeds", InvalidCalendarFeed, maxCalendarFeeds)
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		log.Println(err)
+		return CalendarFeed{}, InternalServerError
+	}
+
+	feed := CalendarFeed{
+		Token:     token,
+		UserID:    userID,
+		Label:     label,
+		CreatedAt: time.UnixMilli(time.Now().UnixMilli()).UTC(),
+	}
+
+	query := `INSERT INTO calendar_feeds (token, user_id, label, created_at) VALUES (?, ?, ?, ?)`
+	result, err := db.Exec(query, token, userID, label, feed.CreatedAt.UnixMilli())
+	if err != nil {
+		log.Println(err)
+		return CalendarFeed{}, InternalServerError
+	}
+
+	feed.ID, err = result.LastInsertId()
+	if err != nil {
+		log.Println(err)
+		return CalendarFeed{}, InternalServerError
+	}
+
+	return feed, nil
+}
+
+func ListCalendarFeeds(userID UserID) ([]CalendarFeed, error) {
+	rows, err := db.Query(calendarFeedQuery+` WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	feeds := []CalendarFeed{}
+	for rows.Next() {
+		feed, err := scanCalendarFeed(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		feeds = append(feeds, feed)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return feeds, nil
+}
+
+// CalendarFeedByToken returns the feed a calendar app presents.
+func CalendarFeedByToken(token string) (CalendarFeed, error) {
+	feed, err := scanCalendarFeed(db.QueryRow(calendarFeedQuery+` WHERE token = ?`, token))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return CalendarFeed{}, NoSuchCalendarFeed
+		}
+		log.Println(err)
+		return CalendarFeed{}, InternalServerError
+	}
+
+	return feed, nil
+}
+
+func RevokeCalendarFeed(userID UserID, feedID CalendarFeedID) error {
+	result, err := db.Exec(`DELETE FROM calendar_feeds WHERE id = ? AND user_id = ?`, feedID, userID)
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+	if rowsAffected != 1 {
+		return NoSuchCalendarFeed
+	}
+
+	return nil
+}
+
+// CalendarFeedRuns returns the completed focus runs a feed publishes.
+func CalendarFeedRuns(feed CalendarFeed, now time.Time) ([]FocusRun, error) {
+	runs, err := ListRuns(feed.UserID, "", now.Add(-calendarFeedHistory), now, now)
+	if err != nil {
+		return nil, err
+	}
+	return completedRuns(runs), nil
+}
+
+// completedRuns drops the runs that go on.
+func completedRuns(runs []FocusRun) []FocusRun {
+	completed := []FocusRun{}
+	for _, run := range runs {
+		if run.EndedAt != nil {
+			completed = append(completed, run)
+		}
+	}
+	return completed
+}
+
+// escapeICalendarText escapes a TEXT value as in RFC 5545, section 3.3.11.
+func escapeICalendarText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(text)
+}
+
+// writeICalendarLine writes a content line, folded into lines of at most 75
+// bytes without splitting characters.
+func writeICalendarLine(writer *bufio.Writer, line string) {
+	limit := maxICalendarLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		writer.WriteString(line[:cut])
+		writer.WriteString("\r\n ")
+		line = line[cut:]
+		// The leading space of continuation lines counts.
+		limit = maxICalendarLineLength - 1
+	}
+	writer.WriteString(line)
+	writer.WriteString("\r\n")
+}
+
+func formatICalendarTime(at time.Time) string {
+	return at.UTC().Format("20060102T150405Z")
+}
+
+func describeRun(run FocusRun) string {
+	description := fmt.Sprintf("Maximum time %v, buff %.2f", time.Duration(run.MaxTime)*time.Millisecond, run.Buff)
+	if run.ReverseMs > 0 {
+		description += fmt.Sprintf(", reversed for %v", (time.Duration(run.ReverseMs) * time.Millisecond).Round(time.Second))
+	}
+	if run.StoppedEarly {
+		description += ", stopped early"
+	}
+	return description
+}
+
+// WriteICalendar writes the runs as an iCalendar (RFC 5545) calendar with an
+// event per run.
+func WriteICalendar(output io.Writer, name string, runs []FocusRun, now time.Time) error {
+	writer := bufio.NewWriter(output)
+	line := func(format string, args ...any) {
+		writeICalendarLine(writer, fmt.Sprintf(format, args...))
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//Flowey//Focus runs//EN")
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	line("X-WR-CALNAME:%s", escapeICalendarText(name))
+	line("REFRESH-INTERVAL;VALUE=DURATION:%s", calendarRefreshInterval)
+	line("X-PUBLISHED-TTL:%s", calendarRefreshInterval)
+
+	for _, run := range runs {
+		line("BEGIN:VEVENT")
+		line("UID:focus-run-%d@flowey", run.ID)
+		line("DTSTAMP:%s", formatICalendarTime(now))
+		line("DTSTART:%s", formatICalendarTime(run.StartedAt))
+		line("DTEND:%s", formatICalendarTime(run.end(now)))
+		line("SUMMARY:%s", escapeICalendarText("Focus: "+run.Timer))
+		line("DESCRIPTION:%s", escapeICalendarText(describeRun(run)))
+		line("TRANSP:OPAQUE")
+		line("END:VEVENT")
+	}
+
+	line("END:VCALENDAR")
+	return writer.Flush()
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Delete deletes the user with its sessions, timers, share tokens, webhooks,
+// push subscriptions, focus runs, calendar feeds, the rooms it owns and its
+// memberships in other rooms. Running servers close the connections of the
+// deleted sessions within -session-check-interval.
+func Delete(username string) error {
+	userID, err := userIDByName(username)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteRooms(tx, `owner_id = ?`, userID); err != nil {
+		return err
+	}
+
+	queries := []string{
+		`DELETE FROM room_members WHERE user_id = ?`,
+		`DELETE FROM shares WHERE user_id = ?`,
+		`DELETE FROM webhook_deliveries WHERE user_id = ?`,
+		`DELETE FROM webhooks WHERE user_id = ?`,
+		`DELETE FROM push_subscriptions WHERE user_id = ?`,
+		`DELETE FROM push_notifications WHERE user_id = ?`,
+		`DELETE FROM focus_runs WHERE user_id = ?`,
+		`DELETE FROM calendar_feeds WHERE user_id = ?`,
+		`DELETE FROM state_history WHERE user_id = ?`,
+		`DELETE FROM states WHERE user_id = ?`,
+		`DELETE FROM timers WHERE user_id = ?`,
+		`DELETE FROM sessions WHERE user_id = ?`,
+		`DELETE FROM users WHERE id = ?`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("deleted %s", username)
+	return nil
+}
+
+func DeleteCmd(args []string, path string) error {
+	flagSet := flag.NewFlagSet("flowey db delete", flag.ExitOnError)
+	skipConfirmation := flagSet.Bool("y", false, "skip confirmation")
+
+	flagSet.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: flowey db delete [OPTIONS] USERNAME")
+		flagSet.PrintDefaults()
+	}
+
+	flagSet.Parse(args)
+
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return nil
+	}
+
+	if !*skipConfirmation && !confirmed() {
+		return nil
+	}
+
+	if err := Prepare(path); err != nil {
+		log.Fatal(err)
+	}
+	defer Close()
+
+	return Delete(flagSet.Arg(0))
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ExportRange returns the times [start, end) the days from to to, inclusive,
+// span in the location. Without from the range starts at the epoch, without
+// to it ends now.
+func ExportRange(from string, to string, location *time.Location, now time.Time) (time.Time, time.Time, error) {
+	start := time.UnixMilli(0)
+	if from != "" {
+		date, err := time.ParseInLocation(dateLayout, from, location)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("%w: couldn't parse the start date", InvalidRange)
+		}
+		start = date
+	}
+
+	end := now
+	if to != "" {
+		date, err := time.ParseInLocation(dateLayout, to, location)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("%w: couldn't parse the end date", InvalidRange)
+		}
+		_, end = day(date)
+	}
+
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, fmt.Errorf("%w: it ends before it starts", InvalidRange)
+	}
+	return start, end, nil
+}
+
+// ExportRuns returns the completed focus runs of the user, or of one of its
+// timers, that overlap [start, end).
+func ExportRuns(userID UserID, timerName string, start time.Time, end time.Time, now time.Time) ([]FocusRun, error) {
+	if timerName != "" {
+		if _, err := GetTimer(userID, timerName); err != nil {
+			return nil, err
+		}
+	}
+
+	runs, err := ListRuns(userID, timerName, start, end, now)
+	if err != nil {
+		return nil, err
+	}
+	return completedRuns(runs), nil
+}
+
+// WriteRunsCSV writes the runs as CSV with a header, times in the location.
+func WriteRunsCSV(output io.Writer, runs []FocusRun, location *time.Location, now time.Time) error {
+	writer := csv.NewWriter(output)
+	writer.Write([]string{"id", "timer", "started_at", "ended_at", "focus_ms", "max_time_ms", "buff", "reverse_ms", "stopped_early"})
+
+	for _, run := range runs {
+		end := run.end(now)
+		writer.Write([]string{
+			strconv.FormatInt(run.ID, 10),
+			run.Timer,
+			run.StartedAt.In(location).Format(time.RFC3339),
+			end.In(location).Format(time.RFC3339),
+			strconv.FormatInt(end.Sub(run.StartedAt).Milliseconds(), 10),
+			strconv.FormatInt(run.MaxTime, 10),
+			strconv.FormatFloat(run.Buff, 'f', 2, 64),
+			strconv.FormatInt(run.ReverseMs, 10),
+			strconv.FormatBool(run.StoppedEarly),
+		})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func ExportRunsCmd(args []string, path string) error {
+	flagSet := flag.NewFlagSet("flowey db export-runs", flag.ExitOnError)
+	format := flagSet.String("format", "csv", "output format: csv or ics")
+	from := flagSet.String("from", "", "first day to export, as YYYY-MM-DD")
+	to := flagSet.String("to", "", "last day to export, as YYYY-MM-DD")
+	timezone := flagSet.String("tz", "UTC", "IANA timezone of the days and CSV times")
+	timerName := flagSet.String("timer", "", "only export the runs of this timer")
+
+	flagSet.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage: flowey db export-runs [OPTIONS] USERNAME
+  Write the completed focus runs of a user to the standard output.`)
+		fmt.Fprintln(os.Stderr)
+		flagSet.PrintDefaults()
+	}
+
+	flagSet.Parse(args)
+
+	if flagSet.NArg() != 1 || (*format != "csv" && *format != "ics") {
+		flagSet.Usage()
+		return nil
+	}
+
+	location, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	start, end, err := ExportRange(*from, *to, location, now)
+	if err != nil {
+		return err
+	}
+
+	if err := Prepare(path); err != nil {
+		log.Fatal(err)
+	}
+	defer Close()
+
+	userID, err := userIDByName(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	runs, err := ExportRuns(userID, *timerName, start, end, now)
+	if err != nil {
+		return err
+	}
+
+	if *format == "ics" {
+		return WriteICalendar(os.Stdout, "Flowey: "+flagSet.Arg(0), runs, now)
+	}
+	return WriteRunsCSV(os.Stdout, runs, location, now)
+}
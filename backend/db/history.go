@@ -0,0 +1,197 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+var NoHistory = errors.New("no matching state in the history")
+
+// change is what the history records about a new revision besides the state.
+// restoredFrom is the revision an undo or restore brought back, if any.
+type change struct {
+	origin       string
+	restoredFrom Revision
+}
+
+// HistoryRetention bounds how much of the history is kept. A zero field
+// disables that bound. The current revision is always kept.
+type HistoryRetention struct {
+	MaxAge     time.Duration
+	MaxEntries int
+}
+
+var historyRetention = HistoryRetention{
+	MaxAge:     30 * 24 * time.Hour,
+	MaxEntries: 1000,
+}
+
+func SetHistoryRetention(retention HistoryRetention) {
+	historyRetention = retention
+}
+
+type HistoryEntry struct {
+	Revision     Revision        `json:"revision"`
+	CreatedAt    time.Time       `json:"createdAt"`
+	Origin       string          `json:"origin"`
+	RestoredFrom *Revision       `json:"restoredFrom,omitempty"`
+	State        json.RawMessage `json:"state"`
+}
+
+func appendHistory(tx *sql.Tx, key StateKey, revision Revision, stateString string, change change) error {
+	restoredFrom := sql.NullInt64{Int64: change.restoredFrom, Valid: change.restoredFrom > 0}
+	now := time.Now()
+
+	query := `INSERT INTO state_history (user_id, timer_id, revision, state, created_at, origin, restored_from)
+VALUES (?, ?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, key.UserID, key.TimerID, revision, stateString, now.UnixMilli(), change.origin, restoredFrom); err != nil {
+		return err
+	}
+
+	if maxAge := historyRetention.MaxAge; maxAge > 0 {
+		query := `DELETE FROM state_history WHERE user_id = ? AND timer_id = ? AND revision < ? AND created_at < ?`
+		if _, err := tx.Exec(query, key.UserID, key.TimerID, revision, now.Add(-maxAge).UnixMilli()); err != nil {
+			return err
+		}
+	}
+
+	if maxEntries := historyRetention.MaxEntries; maxEntries > 0 {
+		query := `DELETE FROM state_history WHERE user_id = ? AND timer_id = ? AND revision <= ?`
+		if _, err := tx.Exec(query, key.UserID, key.TimerID, revision-Revision(maxEntries)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scanHistoryEntry(scanner interface{ Scan(...any) error }) (HistoryEntry, error) {
+	var entry HistoryEntry
+	var createdAt int64
+	var restoredFrom sql.NullInt64
+	var stateString string
+
+	if err := scanner.Scan(&entry.Revision, &stateString, &createdAt, &entry.Origin, &restoredFrom); err != nil {
+		return HistoryEntry{}, err
+	}
+
+	entry.CreatedAt = time.UnixMilli(createdAt).UTC()
+	if restoredFrom.Valid {
+		entry.RestoredFrom = &restoredFrom.Int64
+	}
+	entry.State = json.RawMessage(stateString)
+
+	return entry, nil
+}
+
+// StateHistory returns up to limit revisions older than before, newest first.
+// A before of 0 starts from the current revision.
+func StateHistory(key StateKey, before Revision, limit int) ([]HistoryEntry, error) {
+	if before <= 0 {
+		before = 1<<63 - 1
+	}
+
+	query := `SELECT revision, state, created_at, origin, restored_from FROM state_history
+WHERE user_id = ? AND timer_id = ? AND revision < ? ORDER BY revision DESC LIMIT ?`
+	rows, err := db.Query(query, key.UserID, key.TimerID, before, limit)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		entry, err := scanHistoryEntry(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return entries, nil
+}
+
+func historyEntry(query string, args ...any) (HistoryEntry, error) {
+	entry, err := scanHistoryEntry(db.QueryRow(query, args...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return HistoryEntry{}, NoHistory
+		}
+		log.Println(err)
+		return HistoryEntry{}, InternalServerError
+	}
+
+	return entry, nil
+}
+
+// restoreState stores an old revision again as the newest one.
+func restoreState(key StateKey, origin string, serverStateString string, serverRevision Revision, entry HistoryEntry) (stateString string, revision Revision, err error) {
+	_, stateString, revision, err = writeState(
+		key, serverRevision, serverStateString, string(entry.State),
+		change{origin: origin, restoredFrom: entry.Revision},
+	)
+	return stateString, revision, err
+}
+
+// UndoState brings back the revision before the current one. Undoing a
+// restore goes back past the revision it restored, so that repeated undos
+// walk further into the past instead of toggling between two states.
+func UndoState(key StateKey, origin string) (stateString string, revision Revision, err error) {
+	serverStateString, serverRevision, err := GetStateRevision(key)
+	if err != nil {
+		return "", 0, err
+	}
+
+	current, err := historyEntry(
+		`SELECT revision, state, created_at, origin, restored_from FROM state_history WHERE user_id = ? AND timer_id = ? AND revision = ?`,
+		key.UserID, key.TimerID, serverRevision,
+	)
+	if err != nil {
+		return "", 0, err
+	}
+
+	base := current.Revision
+	if current.RestoredFrom != nil {
+		base = *current.RestoredFrom
+	}
+
+	previous, err := historyEntry(
+		`SELECT revision, state, created_at, origin, restored_from FROM state_history
+WHERE user_id = ? AND timer_id = ? AND revision < ? ORDER BY revision DESC LIMIT 1`,
+		key.UserID, key.TimerID, base,
+	)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return restoreState(key, origin, serverStateString, serverRevision, previous)
+}
+
+// RestoreState brings back the state as it was at the given time.
+func RestoreState(key StateKey, origin string, at time.Time) (stateString string, revision Revision, err error) {
+	serverStateString, serverRevision, err := GetStateRevision(key)
+	if err != nil {
+		return "", 0, err
+	}
+
+	entry, err := historyEntry(
+		`SELECT revision, state, created_at, origin, restored_from FROM state_history
+WHERE user_id = ? AND timer_id = ? AND created_at <= ? ORDER BY revision DESC LIMIT 1`,
+		key.UserID, key.TimerID, at.UnixMilli(),
+	)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return restoreState(key, origin, serverStateString, serverRevision, entry)
+}
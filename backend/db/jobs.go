@@ -0,0 +1,413 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	InvalidJob = errors.New("invalid job")
+	// LostLease means the job was taken over by another runner after its
+	// lease expired, so the outcome wasn't recorded.
+	LostLease = errors.New("the lease on the job was lost")
+)
+
+const defaultMaxJobAttempts = 5
+
+type JobID = int64
+
+type JobStatus string
+
+const (
+	JobPending JobStatus = "pending"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job is a piece of work of a named kind to run at a later time. A running
+// job is leased to one runner until LeaseUntil; if the runner doesn't finish
+// it by then, another one may take it over.
+type Job struct {
+	ID          JobID
+	Kind        string
+	Key         string
+	Payload     string
+	Status      JobStatus
+	Attempts    int
+	MaxAttempts int
+	RunAt       time.Time
+	LeaseOwner  string
+	LeaseUntil  *time.Time
+	LastError   string
+	CreatedAt   time.Time
+	FinishedAt  *time.Time
+}
+
+// NewJob is a job to enqueue. A job with a key is unique among the pending
+// jobs of its kind. MaxAttempts defaults to 5.
+type NewJob struct {
+	Kind        string
+	Key         string
+	Payload     string
+	RunAt       time.Time
+	MaxAttempts int
+}
+
+var jobsQueued = make(chan struct{}, 1)
+
+// JobsQueued receives a value when a job was enqueued, so that a runner
+// waiting for the next one can look again.
+func JobsQueued() <-chan struct{} {
+	return jobsQueued
+}
+
+func notifyJobs() {
+	select {
+	case jobsQueued <- struct{}{}:
+	default:
+	}
+}
+
+// replaceJob is the conflict clause of EnqueueJob.
+const replaceJob = `DO UPDATE SET
+  payload = excluded.payload, run_at = excluded.run_at, max_attempts = excluded.max_attempts`
+
+const jobColumns = `id, kind, key, payload, status, attempts, max_attempts, run_at, lease_owner, lease_until, last_error, created_at, finished_at`
+
+func scanJob(scanner interface{ Scan(...any) error }) (Job, error) {
+	var job Job
+	var runAt, createdAt int64
+	var leaseUntil, finishedAt sql.NullInt64
+
+	if err := scanner.Scan(
+		&job.ID, &job.Kind, &job.Key, &job.Payload, &job.Status, &job.Attempts, &job.MaxAttempts,
+		&runAt, &job.LeaseOwner, &leaseUntil, &job.LastError, &createdAt, &finishedAt,
+	); err != nil {
+		return Job{}, err
+	}
+
+	job.RunAt = time.UnixMilli(runAt).UTC()
+	job.CreatedAt = time.UnixMilli(createdAt).UTC()
+	if leaseUntil.Valid {
+		at := time.UnixMilli(leaseUntil.Int64).UTC()
+		job.LeaseUntil = &at
+	}
+	if finishedAt.Valid {
+		at := time.UnixMilli(finishedAt.Int64).UTC()
+		job.FinishedAt = &at
+	}
+
+	return job, nil
+}
+
+// enqueueJob queues a job with db or in a transaction. The caller notifies
+// runners once the job is committed.
+func enqueueJob(queryer interface {
+	QueryRow(string, ...any) *sql.Row
+}, job NewJob, now time.Time, onConflict string) (Job, error) {
+	if job.Kind == "" {
+		return Job{}, fmt.Errorf("%w: it has no kind", InvalidJob)
+	}
+	if job.MaxAttempts <= 0 {
+		job.MaxAttempts = defaultMaxJobAttempts
+	}
+
+	query := `INSERT INTO jobs (kind, key, payload, status, attempts, max_attempts, run_at, lease_owner, last_error, created_at)
+VALUES (?, ?, ?, ?, 0, ?, ?, '', '', ?)
+ON CONFLICT (kind, key) WHERE status = 'pending' AND key != '' ` + onConflict + `
+RETURNING ` + jobColumns
+	queued, err := scanJob(queryer.QueryRow(
+		query, job.Kind, job.Key, job.Payload, JobPending, job.MaxAttempts,
+		job.RunAt.UnixMilli(), now.UnixMilli(),
+	))
+	if err == sql.ErrNoRows {
+		return Job{}, nil
+	}
+	if err != nil {
+		log.Println(err)
+		return Job{}, InternalServerError
+	}
+
+	return queued, nil
+}
+
+// cancelJob deletes the pending job of the kind with the key, if there is one.
+func cancelJob(tx *sql.Tx, kind string, key string) error {
+	_, err := tx.Exec(`DELETE FROM jobs WHERE kind = ? AND key = ? AND status = ?`, kind, key, JobPending)
+	return err
+}
+
+// EnqueueJob queues a job. If a pending job of the kind has the same key, its
+// payload, run time and attempts are replaced instead.
+func EnqueueJob(job NewJob, now time.Time) (Job, error) {
+	queued, err := enqueueJob(db, job, now, replaceJob)
+	if err == nil {
+		notifyJobs()
+	}
+	return queued, err
+}
+
+// EnsureJob queues a job unless a pending job of the kind has the same key,
+// for recurring jobs that must be queued once.
+func EnsureJob(job NewJob, now time.Time) error {
+	if job.Key == "" {
+		return fmt.Errorf("%w: only jobs with a key can be ensured", InvalidJob)
+	}
+	_, err := enqueueJob(db, job, now, `DO NOTHING`)
+	if err == nil {
+		notifyJobs()
+	}
+	return err
+}
+
+// ClaimJobs leases up to limit due jobs of the given kinds to owner until
+// now plus lease, oldest first. Running jobs whose lease expired are due
+// again, or failed if they ran out of attempts.
+func ClaimJobs(owner string, kinds []string, now time.Time, lease time.Duration, limit int) ([]Job, error) {
+	if len(kinds) == 0 {
+		return nil, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE jobs SET status = ?, lease_owner = '', lease_until = NULL, finished_at = ?, last_error = 'the lease expired'
+WHERE status = ? AND lease_until <= ? AND attempts >= max_attempts`
+	if _, err := tx.Exec(query, JobFailed, now.UnixMilli(), JobRunning, now.UnixMilli()); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	args := []any{JobRunning, owner, now.Add(lease).UnixMilli()}
+	for _, kind := range kinds {
+		args = append(args, kind)
+	}
+	args = append(args, JobPending, now.UnixMilli(), JobRunning, now.UnixMilli(), limit)
+
+	query = `UPDATE jobs SET status = ?, lease_owner = ?, lease_until = ?, attempts = attempts + 1
+WHERE id IN (
+  SELECT id FROM jobs
+  WHERE kind IN (?` + strings.Repeat(", ?", len(kinds)-1) + `)
+    AND ((status = ? AND run_at <= ?) OR (status = ? AND lease_until <= ?))
+  ORDER BY run_at, id LIMIT ?
+)
+RETURNING ` + jobColumns
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	rows.Close()
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return jobs, nil
+}
+
+func finishJob(job Job, query string, args ...any) error {
+	result, err := db.Exec(query, append(args, job.ID, job.LeaseOwner, JobRunning)...)
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+	if updated == 0 {
+		return LostLease
+	}
+
+	return nil
+}
+
+// CompleteJob records that a claimed job succeeded.
+func CompleteJob(job Job, now time.Time) error {
+	query := `UPDATE jobs SET status = ?, lease_owner = '', lease_until = NULL, last_error = '', finished_at = ?
+WHERE id = ? AND lease_owner = ? AND status = ?`
+	return finishJob(job, query, JobDone, now.UnixMilli())
+}
+
+// FailJob records that a claimed job failed. It's retried after the backoff
+// unless it's final, the job ran out of attempts or a job with the same key
+// was queued in the meantime.
+func FailJob(job Job, now time.Time, jobErr error, backoff time.Duration, final bool) error {
+	errorText := truncate(jobErr.Error(), maxErrorLength)
+
+	superseded := false
+	if job.Key != "" {
+		query := `SELECT EXISTS (SELECT 1 FROM jobs WHERE kind = ? AND key = ? AND status = ?)`
+		if err := db.QueryRow(query, job.Kind, job.Key, JobPending).Scan(&superseded); err != nil {
+			log.Println(err)
+			return InternalServerError
+		}
+	}
+
+	if final || superseded || job.Attempts >= job.MaxAttempts {
+		query := `UPDATE jobs SET status = ?, lease_owner = '', lease_until = NULL, last_error = ?, finished_at = ?
+WHERE id = ? AND lease_owner = ? AND status = ?`
+		return finishJob(job, query, JobFailed, errorText, now.UnixMilli())
+	}
+
+	query := `UPDATE jobs SET status = ?, lease_owner = '', lease_until = NULL, last_error = ?, run_at = ?
+WHERE id = ? AND lease_owner = ? AND status = ?`
+	return finishJob(job, query, JobPending, errorText, now.Add(backoff).UnixMilli())
+}
+
+// NextJobAt returns when the earliest pending job of the given kinds is due,
+// or the earliest lease of a running one expires.
+func NextJobAt(kinds []string) (at time.Time, ok bool, err error) {
+	if len(kinds) == 0 {
+		return time.Time{}, false, nil
+	}
+
+	args := []any{JobPending, JobPending, JobRunning}
+	for _, kind := range kinds {
+		args = append(args, kind)
+	}
+
+	var next sql.NullInt64
+	query := `SELECT MIN(CASE status WHEN ? THEN run_at ELSE lease_until END) FROM jobs
+WHERE status IN (?, ?) AND kind IN (?` + strings.Repeat(", ?", len(kinds)-1) + `)`
+	if err := db.QueryRow(query, args...).Scan(&next); err != nil {
+		log.Println(err)
+		return time.Time{}, false, InternalServerError
+	}
+	if !next.Valid {
+		return time.Time{}, false, nil
+	}
+	return time.UnixMilli(next.Int64), true, nil
+}
+
+// PruneJobs deletes the jobs that finished before the given time.
+func PruneJobs(before time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM jobs WHERE status IN (?, ?) AND finished_at < ?`, JobDone, JobFailed, before.UnixMilli())
+	if err != nil {
+		log.Println(err)
+		return 0, InternalServerError
+	}
+	return result.RowsAffected()
+}
+
+// ListJobs returns the jobs with the given status, or all of them, by when
+// they run.
+func ListJobs(status JobStatus) ([]Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE ? = '' OR status = ? ORDER BY run_at, id`
+	rows, err := db.Query(query, status, status)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return jobs, nil
+}
+
+func printJobs(jobs []Job) {
+	formatTime := func(at *time.Time) string {
+		if at == nil {
+			return "-"
+		}
+		return at.Format(time.RFC3339)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tKIND\tKEY\tSTATUS\tATTEMPTS\tRUN AT\tLEASE\tERROR")
+	for _, job := range jobs {
+		lease := "-"
+		if job.Status == JobRunning {
+			lease = job.LeaseOwner + " until " + formatTime(job.LeaseUntil)
+		}
+		fmt.Fprintf(
+			writer, "%d\t%s\t%s\t%s\t%d/%d\t%s\t%s\t%s\n",
+			job.ID, job.Kind, job.Key, job.Status, job.Attempts, job.MaxAttempts,
+			job.RunAt.Format(time.RFC3339), lease, job.LastError,
+		)
+	}
+	writer.Flush()
+}
+
+func JobsCmd(args []string, path string) error {
+	flagSet := flag.NewFlagSet("flowey db jobs", flag.ExitOnError)
+	status := flagSet.String("status", "", "only list jobs with this status: pending, running, done or failed")
+
+	flagSet.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage: flowey db jobs [OPTIONS] COMMAND
+  list    list the queued, running and recently finished jobs`)
+		fmt.Fprintln(os.Stderr)
+		flagSet.PrintDefaults()
+	}
+
+	flagSet.Parse(args)
+
+	if flagSet.NArg() != 1 || flagSet.Arg(0) != "list" {
+		flagSet.Usage()
+		return nil
+	}
+
+	switch JobStatus(*status) {
+	case "", JobPending, JobRunning, JobDone, JobFailed:
+	default:
+		flagSet.Usage()
+		return nil
+	}
+
+	if err := Prepare(path); err != nil {
+		log.Fatal(err)
+	}
+	defer Close()
+
+	jobs, err := ListJobs(JobStatus(*status))
+	if err != nil {
+		return err
+	}
+	printJobs(jobs)
+
+	return nil
+}
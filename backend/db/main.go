@@ -20,8 +20,14 @@ func Main(args []string) {
 
 	flagSet.Usage = func() {
 		fmt.Fprintln(os.Stderr, `Usage of flowey db:
-  add       add a user to the database
-  prepare   prepare a database`)
+  add           add a user to the database
+  delete        delete a user and everything it owns
+  export-runs   export the focus runs of a user as CSV or iCalendar
+  jobs          inspect the job queue of the server
+  passwd        reset the password of a user
+  prepare       prepare a database
+  rooms         manage shared timer rooms
+  vapid         manage the Web Push key`)
 		fmt.Fprintln(os.Stderr)
 		flagSet.PrintDefaults()
 	}
@@ -39,10 +45,34 @@ func Main(args []string) {
 		if err := AddCmd(nextArgs, *path); err != nil {
 			log.Fatal(err)
 		}
+	case "delete":
+		if err := DeleteCmd(nextArgs, *path); err != nil {
+			log.Fatal(err)
+		}
+	case "export-runs":
+		if err := ExportRunsCmd(nextArgs, *path); err != nil {
+			log.Fatal(err)
+		}
+	case "jobs":
+		if err := JobsCmd(nextArgs, *path); err != nil {
+			log.Fatal(err)
+		}
+	case "passwd":
+		if err := PasswdCmd(nextArgs, *path); err != nil {
+			log.Fatal(err)
+		}
 	case "prepare":
 		if err := PrepareCmd(nextArgs, *path); err != nil {
 			log.Fatal(err)
 		}
+	case "rooms":
+		if err := RoomsCmd(nextArgs, *path); err != nil {
+			log.Fatal(err)
+		}
+	case "vapid":
+		if err := VapidCmd(nextArgs, *path); err != nil {
+			log.Fatal(err)
+		}
 	default:
 		flagSet.Usage()
 	}
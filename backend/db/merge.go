@@ -0,0 +1,228 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"maps"
+	"reflect"
+	"time"
+
+	"flowey/hlc"
+)
+
+// clocksKey is the top-level key holding the hybrid logical clock timestamp of
+// every other top-level key of a state. States without it are merged as a
+// whole, the way legacy clients expect.
+const clocksKey = "hlc"
+
+// clock stamps fields changed without a newer timestamp. It never observes
+// client timestamps, so that no client can move it ahead for everyone.
+var clock = hlc.NewClock("server", nil)
+
+// maxClockError is how far ahead of the server clock a client timestamp may
+// be. Later ones are clamped, so that a field can't win every merge forever.
+var maxClockError = 2 * time.Minute
+
+func SetMaxClockError(maxError time.Duration) {
+	maxClockError = maxError
+}
+
+// clampClocks pulls client timestamps that are too far ahead back to the
+// latest plausible time.
+func clampClocks(clocks map[string]hlc.Timestamp) {
+	latest := time.Now().Add(maxClockError).UnixMilli()
+	for key, timestamp := range clocks {
+		if timestamp.Wall > latest {
+			clocks[key] = hlc.Timestamp{Wall: latest, Logical: timestamp.Logical, Node: timestamp.Node}
+		}
+	}
+}
+
+// stampAfter returns a server timestamp later than after.
+func stampAfter(after hlc.Timestamp) hlc.Timestamp {
+	timestamp := clock.Now()
+	if hlc.Compare(timestamp, after) <= 0 {
+		timestamp = hlc.Timestamp{Wall: after.Wall, Logical: after.Logical + 1, Node: timestamp.Node}
+	}
+	return timestamp
+}
+
+func parseFields(stateString string) (fields map[string]json.RawMessage, clocks map[string]hlc.Timestamp, err error) {
+	fields = make(map[string]json.RawMessage)
+	clocks = make(map[string]hlc.Timestamp)
+	if stateString == "" {
+		return fields, clocks, nil
+	}
+
+	if err := json.Unmarshal([]byte(stateString), &fields); err != nil || fields == nil {
+		return nil, nil, InvalidState
+	}
+
+	if clocksBytes, ok := fields[clocksKey]; ok {
+		if err := json.Unmarshal(clocksBytes, &clocks); err != nil || clocks == nil {
+			return nil, nil, InvalidState
+		}
+		delete(fields, clocksKey)
+	}
+
+	return fields, clocks, nil
+}
+
+func encodeFields(fields map[string]json.RawMessage, clocks map[string]hlc.Timestamp) (string, error) {
+	fields = maps.Clone(fields)
+	if len(clocks) > 0 {
+		clocksBytes, err := json.Marshal(clocks)
+		if err != nil {
+			log.Printf("failed to marshal clocks: %v", err)
+			return "", InternalServerError
+		}
+		fields[clocksKey] = clocksBytes
+	}
+
+	stateBytes, err := json.Marshal(fields)
+	if err != nil {
+		log.Printf("failed to marshal state: %v", err)
+		return "", InternalServerError
+	}
+
+	return string(stateBytes), nil
+}
+
+func equalValues(a json.RawMessage, b json.RawMessage) bool {
+	var aValue, bValue any
+
+	aDecoder := json.NewDecoder(bytes.NewReader(a))
+	aDecoder.UseNumber()
+	if err := aDecoder.Decode(&aValue); err != nil {
+		return false
+	}
+
+	bDecoder := json.NewDecoder(bytes.NewReader(b))
+	bDecoder.UseNumber()
+	if err := bDecoder.Decode(&bValue); err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(aValue, bValue)
+}
+
+// mergeFields takes every field the client has a newer timestamp for. A field
+// with a timestamp but no value was removed by the client.
+func mergeFields(
+	serverFields map[string]json.RawMessage, serverClocks map[string]hlc.Timestamp,
+	clientFields map[string]json.RawMessage, clientClocks map[string]hlc.Timestamp,
+) (map[string]json.RawMessage, map[string]hlc.Timestamp) {
+	fields := maps.Clone(serverFields)
+	clocks := maps.Clone(serverClocks)
+
+	for key, timestamp := range clientClocks {
+		if key == "version" {
+			continue
+		}
+
+		if hlc.Compare(timestamp, serverClocks[key]) <= 0 {
+			continue
+		}
+
+		if value, ok := clientFields[key]; ok {
+			fields[key] = value
+		} else {
+			delete(fields, key)
+		}
+		clocks[key] = timestamp
+	}
+
+	return fields, clocks
+}
+
+// stampFields gives every field that changed without a newer timestamp one
+// from the server clock, so that a whole-state write from a legacy client
+// still wins over older field edits.
+func stampFields(
+	serverFields map[string]json.RawMessage, serverClocks map[string]hlc.Timestamp,
+	fields map[string]json.RawMessage, clocks map[string]hlc.Timestamp,
+) {
+	keys := maps.Clone(fields)
+	maps.Copy(keys, serverFields)
+
+	for key := range keys {
+		if key == "version" {
+			continue
+		}
+
+		serverValue, inServer := serverFields[key]
+		value, inState := fields[key]
+		if inServer == inState && (!inState || equalValues(serverValue, value)) {
+			continue
+		}
+
+		if hlc.Compare(clocks[key], serverClocks[key]) <= 0 {
+			clocks[key] = stampAfter(serverClocks[key])
+		}
+	}
+}
+
+// withClocks carries the field timestamps of the stored state over to a state
+// that is about to replace it. States of users that never sent timestamps are
+// left alone.
+func withClocks(serverStateString string, stateString string) (string, error) {
+	serverFields, serverClocks, err := parseFields(serverStateString)
+	if err != nil {
+		return "", err
+	}
+
+	fields, clocks, err := parseFields(stateString)
+	if err != nil {
+		return "", err
+	}
+	clampClocks(clocks)
+
+	if len(serverClocks) == 0 && len(clocks) == 0 {
+		return stateString, nil
+	}
+
+	for key, timestamp := range serverClocks {
+		if hlc.Compare(timestamp, clocks[key]) > 0 {
+			clocks[key] = timestamp
+		}
+	}
+	stampFields(serverFields, serverClocks, fields, clocks)
+
+	return encodeFields(fields, clocks)
+}
+
+// mergeState merges a client state carrying field timestamps into the stored
+// one field by field, so that concurrent edits of different fields both
+// survive regardless of the version the client started from. If the merge
+// changes nothing, it returns the stored state without pushing it.
+func mergeState(key StateKey, origin string, serverStateString string, serverRevision Revision, clientStateString string) (push bool, stateString string, revision Revision, err error) {
+	serverFields, serverClocks, err := parseFields(serverStateString)
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	clientFields, clientClocks, err := parseFields(clientStateString)
+	if err != nil {
+		return false, "", 0, err
+	}
+	clampClocks(clientClocks)
+
+	fields, clocks := mergeFields(serverFields, serverClocks, clientFields, clientClocks)
+	mergedStateString, err := encodeFields(fields, clocks)
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	if equalStates(mergedStateString, serverStateString) {
+		// Nothing the client sent wins; only the sender needs the state.
+		return false, serverStateString, serverRevision, nil
+	}
+
+	_, stateString, revision, err = writeState(key, serverRevision, serverStateString, mergedStateString, change{origin: origin})
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	return true, stateString, revision, nil
+}
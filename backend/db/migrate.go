@@ -0,0 +1,242 @@
+package db
+
+import (
+	"fmt"
+	"log"
+)
+
+// migrations bring a database created by Init up to date. Each entry runs in
+// its own transaction, and PRAGMA user_version records how many of them have
+// been applied. Append new entries; never edit or reorder existing ones.
+var migrations = []string{
+	// Move the state revision out of the JSON blob into its own column.
+	`ALTER TABLE states ADD COLUMN revision INTEGER NOT NULL DEFAULT 0;
+UPDATE states SET revision = COALESCE(json_extract(state, '$.version'), 0)`,
+	// Keep every accepted revision for undo and restore.
+	`CREATE TABLE state_history(
+  user_id INTEGER NOT NULL,
+  revision INTEGER NOT NULL,
+  state TEXT NOT NULL,
+  created_at INTEGER NOT NULL,
+  origin TEXT NOT NULL,
+  restored_from INTEGER,
+  PRIMARY KEY (user_id, revision)
+);
+INSERT INTO state_history (user_id, revision, state, created_at, origin)
+SELECT user_id, revision, state, CAST(strftime('%s', 'now') AS INTEGER) * 1000, '' FROM states`,
+	// Allow several named timers per user. The existing state of every user
+	// becomes its default timer.
+	`CREATE TABLE timers(
+  id INTEGER NOT NULL PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  name TEXT NOT NULL,
+  created_at INTEGER NOT NULL,
+  UNIQUE (user_id, name)
+);
+INSERT INTO timers (user_id, name, created_at)
+SELECT id, 'default', CAST(strftime('%s', 'now') AS INTEGER) * 1000 FROM users;
+CREATE TABLE timer_states(
+  user_id INTEGER NOT NULL,
+  timer_id INTEGER NOT NULL,
+  state TEXT NOT NULL,
+  revision INTEGER NOT NULL,
+  PRIMARY KEY (user_id, timer_id)
+);
+INSERT INTO timer_states (user_id, timer_id, state, revision)
+SELECT states.user_id, timers.id, states.state, states.revision
+FROM states JOIN timers ON timers.user_id = states.user_id AND timers.name = 'default';
+DROP TABLE states;
+ALTER TABLE timer_states RENAME TO states;
+CREATE TABLE timer_state_history(
+  user_id INTEGER NOT NULL,
+  timer_id INTEGER NOT NULL,
+  revision INTEGER NOT NULL,
+  state TEXT NOT NULL,
+  created_at INTEGER NOT NULL,
+  origin TEXT NOT NULL,
+  restored_from INTEGER,
+  PRIMARY KEY (user_id, timer_id, revision)
+);
+INSERT INTO timer_state_history (user_id, timer_id, revision, state, created_at, origin, restored_from)
+SELECT state_history.user_id, timers.id, revision, state, state_history.created_at, origin, restored_from
+FROM state_history JOIN timers ON timers.user_id = state_history.user_id AND timers.name = 'default';
+DROP TABLE state_history;
+ALTER TABLE timer_state_history RENAME TO state_history`,
+	// Share timers in rooms.
+	`CREATE TABLE rooms(
+  id INTEGER NOT NULL PRIMARY KEY,
+  name TEXT NOT NULL,
+  owner_id INTEGER NOT NULL,
+  timer_id INTEGER NOT NULL UNIQUE,
+  created_at INTEGER NOT NULL
+);
+CREATE TABLE room_members(
+  room_id INTEGER NOT NULL,
+  user_id INTEGER NOT NULL,
+  role TEXT NOT NULL,
+  joined_at INTEGER NOT NULL,
+  PRIMARY KEY (room_id, user_id)
+)`,
+	// Let spectators follow a timer with a share token.
+	`CREATE TABLE shares(
+  id INTEGER NOT NULL PRIMARY KEY,
+  token TEXT NOT NULL UNIQUE,
+  user_id INTEGER NOT NULL,
+  timer_id INTEGER NOT NULL,
+  label TEXT NOT NULL,
+  created_at INTEGER NOT NULL,
+  expires_at INTEGER
+)`,
+	// Record where and when sessions were created and last seen, and name
+	// them by an ID that doesn't reveal the token.
+	`CREATE TABLE session_infos(
+  session_token TEXT NOT NULL PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  id TEXT NOT NULL UNIQUE,
+  label TEXT NOT NULL,
+  user_agent TEXT NOT NULL,
+  ip TEXT NOT NULL,
+  created_at INTEGER NOT NULL,
+  last_seen_at INTEGER NOT NULL
+);
+INSERT INTO session_infos (session_token, user_id, id, label, user_agent, ip, created_at, last_seen_at)
+SELECT session_token, user_id, lower(hex(randomblob(12))), '', '', '',
+  CAST(strftime('%s', 'now') AS INTEGER) * 1000, CAST(strftime('%s', 'now') AS INTEGER) * 1000
+FROM sessions;
+DROP TABLE sessions;
+ALTER TABLE session_infos RENAME TO sessions`,
+	// Deliver timer events to webhooks through an outbox that also keeps a
+	// log of recent deliveries.
+	`CREATE TABLE webhooks(
+  id INTEGER NOT NULL PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  events TEXT NOT NULL,
+  created_at INTEGER NOT NULL
+);
+CREATE TABLE webhook_deliveries(
+  id INTEGER NOT NULL PRIMARY KEY,
+  webhook_id INTEGER NOT NULL,
+  user_id INTEGER NOT NULL,
+  timer_id INTEGER,
+  event TEXT NOT NULL,
+  payload TEXT NOT NULL,
+  status TEXT NOT NULL,
+  attempts INTEGER NOT NULL,
+  created_at INTEGER NOT NULL,
+  next_attempt_at INTEGER NOT NULL,
+  completed_at INTEGER,
+  response_status INTEGER,
+  error TEXT NOT NULL
+);
+CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)`,
+	// Send Web Push messages when timers finish.
+	`CREATE TABLE vapid_keys(
+  id INTEGER NOT NULL PRIMARY KEY,
+  private_key TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  created_at INTEGER NOT NULL
+);
+CREATE TABLE push_subscriptions(
+  id INTEGER NOT NULL PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  device TEXT NOT NULL,
+  endpoint TEXT NOT NULL UNIQUE,
+  p256dh TEXT NOT NULL,
+  auth TEXT NOT NULL,
+  created_at INTEGER NOT NULL
+);
+CREATE TABLE push_notifications(
+  user_id INTEGER NOT NULL,
+  timer_id INTEGER NOT NULL,
+  revision INTEGER NOT NULL,
+  notified_at INTEGER NOT NULL,
+  PRIMARY KEY (user_id, timer_id)
+)`,
+	// Run work at a later time, surviving restarts.
+	`CREATE TABLE jobs(
+  id INTEGER NOT NULL PRIMARY KEY,
+  kind TEXT NOT NULL,
+  key TEXT NOT NULL,
+  payload TEXT NOT NULL,
+  status TEXT NOT NULL,
+  attempts INTEGER NOT NULL,
+  max_attempts INTEGER NOT NULL,
+  run_at INTEGER NOT NULL,
+  lease_owner TEXT NOT NULL,
+  lease_until INTEGER,
+  last_error TEXT NOT NULL,
+  created_at INTEGER NOT NULL,
+  finished_at INTEGER
+);
+CREATE INDEX jobs_due ON jobs (status, run_at);
+CREATE UNIQUE INDEX jobs_pending_key ON jobs (kind, key) WHERE status = 'pending' AND key != ''`,
+	// Keep a log of focus runs, from start to stop or finish.
+	`CREATE TABLE focus_runs(
+  id INTEGER NOT NULL PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  timer_id INTEGER NOT NULL,
+  started_at INTEGER NOT NULL,
+  ended_at INTEGER,
+  finishes_at INTEGER NOT NULL,
+  max_time INTEGER NOT NULL,
+  buff REAL NOT NULL,
+  reverse_ms INTEGER NOT NULL,
+  reversed_at INTEGER,
+  stopped_early INTEGER NOT NULL
+);
+CREATE INDEX focus_runs_user ON focus_runs (user_id, started_at)`,
+	// Publish the focus runs of a user at secret calendar subscription URLs.
+	`CREATE TABLE calendar_feeds(
+  id INTEGER NOT NULL PRIMARY KEY,
+  token TEXT NOT NULL UNIQUE,
+  user_id INTEGER NOT NULL,
+  label TEXT NOT NULL,
+  created_at INTEGER NOT NULL
+)`,
+}
+
+func schemaVersion() (int, error) {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+func Migrate() error {
+	version, err := schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("the database schema (version %d) is newer than this binary (version %d)", version, len(migrations))
+	}
+
+	for index := version; index < len(migrations); index++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migrations[index]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", index+1, err)
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, index+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		log.Printf("applied migration %d", index+1)
+	}
+
+	return nil
+}
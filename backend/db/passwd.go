@@ -0,0 +1,80 @@
+package db
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Passwd gives the user a new random password and logs it out everywhere.
+// Running servers close the connections of the deleted sessions within
+// -session-check-interval.
+func Passwd(username string, passwordLength int) error {
+	userID, err := userIDByName(username)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("username: %s\n", username)
+
+	password, err := generatePassword(passwordLength)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("password: %s\n", password)
+
+	hashedPassword, err := hash(password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("    hash: %s\n", hashedPassword)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET password = ? WHERE id = ?`, hashedPassword, userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func PasswdCmd(args []string, path string) error {
+	flagSet := flag.NewFlagSet("flowey db passwd", flag.ExitOnError)
+	passwordLength := flagSet.Int("l", 40, "password length")
+	skipConfirmation := flagSet.Bool("y", false, "skip confirmation")
+
+	flagSet.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: flowey db passwd [OPTIONS] USERNAME")
+		flagSet.PrintDefaults()
+	}
+
+	flagSet.Parse(args)
+
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return nil
+	}
+
+	if !*skipConfirmation && !confirmed() {
+		return nil
+	}
+
+	if err := Prepare(path); err != nil {
+		log.Fatal(err)
+	}
+	defer Close()
+
+	username := flagSet.Arg(0)
+	return Passwd(username, *passwordLength)
+}
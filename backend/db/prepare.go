@@ -45,10 +45,134 @@ func Validate(path string) error {
 		"sessions": {
 			{cid: 0, name: "session_token", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 1},
 			{cid: 1, name: "user_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 2, name: "id", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "label", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 4, name: "user_agent", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 5, name: "ip", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 6, name: "created_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 7, name: "last_seen_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+		},
+		"timers": {
+			{cid: 0, name: "id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "user_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 2, name: "name", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "created_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
 		},
 		"states": {
 			{cid: 0, name: "user_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
-			{cid: 1, name: "state", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 1, name: "timer_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 2},
+			{cid: 2, name: "state", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "revision", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+		},
+		"state_history": {
+			{cid: 0, name: "user_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "timer_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 2},
+			{cid: 2, name: "revision", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 3},
+			{cid: 3, name: "state", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 4, name: "created_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 5, name: "origin", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 6, name: "restored_from", typeDef: "INTEGER", notnull: 0, dflt_value: nil, pk: 0},
+		},
+		"rooms": {
+			{cid: 0, name: "id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "name", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 2, name: "owner_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "timer_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 4, name: "created_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+		},
+		"room_members": {
+			{cid: 0, name: "room_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "user_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 2},
+			{cid: 2, name: "role", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "joined_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+		},
+		"shares": {
+			{cid: 0, name: "id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "token", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 2, name: "user_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "timer_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 4, name: "label", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 5, name: "created_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 6, name: "expires_at", typeDef: "INTEGER", notnull: 0, dflt_value: nil, pk: 0},
+		},
+		"webhooks": {
+			{cid: 0, name: "id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "user_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 2, name: "url", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "secret", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 4, name: "events", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 5, name: "created_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+		},
+		"webhook_deliveries": {
+			{cid: 0, name: "id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "webhook_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 2, name: "user_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "timer_id", typeDef: "INTEGER", notnull: 0, dflt_value: nil, pk: 0},
+			{cid: 4, name: "event", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 5, name: "payload", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 6, name: "status", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 7, name: "attempts", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 8, name: "created_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 9, name: "next_attempt_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 10, name: "completed_at", typeDef: "INTEGER", notnull: 0, dflt_value: nil, pk: 0},
+			{cid: 11, name: "response_status", typeDef: "INTEGER", notnull: 0, dflt_value: nil, pk: 0},
+			{cid: 12, name: "error", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+		},
+		"vapid_keys": {
+			{cid: 0, name: "id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "private_key", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 2, name: "subject", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "created_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+		},
+		"push_subscriptions": {
+			{cid: 0, name: "id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "user_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 2, name: "device", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "endpoint", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 4, name: "p256dh", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 5, name: "auth", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 6, name: "created_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+		},
+		"push_notifications": {
+			{cid: 0, name: "user_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "timer_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 2},
+			{cid: 2, name: "revision", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "notified_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+		},
+		"jobs": {
+			{cid: 0, name: "id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "kind", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 2, name: "key", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "payload", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 4, name: "status", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 5, name: "attempts", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 6, name: "max_attempts", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 7, name: "run_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 8, name: "lease_owner", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 9, name: "lease_until", typeDef: "INTEGER", notnull: 0, dflt_value: nil, pk: 0},
+			{cid: 10, name: "last_error", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 11, name: "created_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 12, name: "finished_at", typeDef: "INTEGER", notnull: 0, dflt_value: nil, pk: 0},
+		},
+		"focus_runs": {
+			{cid: 0, name: "id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "user_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 2, name: "timer_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "started_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 4, name: "ended_at", typeDef: "INTEGER", notnull: 0, dflt_value: nil, pk: 0},
+			{cid: 5, name: "finishes_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 6, name: "max_time", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 7, name: "buff", typeDef: "REAL", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 8, name: "reverse_ms", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 9, name: "reversed_at", typeDef: "INTEGER", notnull: 0, dflt_value: nil, pk: 0},
+			{cid: 10, name: "stopped_early", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+		},
+		"calendar_feeds": {
+			{cid: 0, name: "id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 1},
+			{cid: 1, name: "token", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 2, name: "user_id", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 3, name: "label", typeDef: "TEXT", notnull: 1, dflt_value: nil, pk: 0},
+			{cid: 4, name: "created_at", typeDef: "INTEGER", notnull: 1, dflt_value: nil, pk: 0},
 		},
 	}
 
@@ -127,11 +251,15 @@ func Prepare(path string) error {
 		return err
 	}
 
-	if occupied {
-		err = Validate(path)
-	} else {
+	if !occupied {
 		err = Init(path)
 	}
+	if err == nil {
+		err = Migrate()
+	}
+	if err == nil {
+		err = Validate(path)
+	}
 	if err != nil {
 		Close()
 		return err
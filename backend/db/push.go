@@ -0,0 +1,364 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"flowey/timer"
+	"flowey/webpush"
+)
+
+var (
+	NoVAPIDKeys            = errors.New("web push isn't configured: run flowey db vapid generate")
+	NoSuchPushSubscription = errors.New("no such push subscription")
+)
+
+// PushSubscription is a browser of a user that gets a push message when one
+// of the user's timers finishes.
+type PushSubscription struct {
+	ID        int64     `json:"id"`
+	Device    string    `json:"device"`
+	Endpoint  string    `json:"endpoint"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// PushFinishedJob is the kind of the jobs that send the push message of a
+// finished timer. State writes queue one per running timer, due when it
+// finishes.
+const PushFinishedJob = "push.finished"
+
+// PushFinishedPayload is the payload of a PushFinishedJob: the revision of
+// the timer that was running when it was written.
+type PushFinishedPayload struct {
+	UserID   UserID   `json:"userId"`
+	TimerID  TimerID  `json:"timerId"`
+	Revision Revision `json:"revision"`
+}
+
+func pushFinishedKey(key StateKey) string {
+	return fmt.Sprintf("%d/%d", key.UserID, key.TimerID)
+}
+
+// finishing returns when a timer written at writtenAt finishes by itself, if
+// it was running.
+func finishing(stateString string, writtenAt int64) (timer.Timer, int64, bool) {
+	state, ok := parseTimer(stateString)
+	if !ok || !state.IsOn(writtenAt) || int64(state.FinishesAt()) <= writtenAt {
+		return timer.Timer{}, 0, false
+	}
+	return state, int64(state.FinishesAt()), true
+}
+
+// queueFinishedPush queues the push job of a timer written at revision, in
+// the transaction of the write, or cancels it if the timer no longer runs. It
+// reports whether a job was queued.
+func queueFinishedPush(tx *sql.Tx, key StateKey, revision Revision, stateString string, now time.Time) (bool, error) {
+	_, finishesAt, ok := finishing(stateString, now.UnixMilli())
+	if !ok {
+		return false, cancelJob(tx, PushFinishedJob, pushFinishedKey(key))
+	}
+
+	payload, err := json.Marshal(PushFinishedPayload{key.UserID, key.TimerID, revision})
+	if err != nil {
+		return false, err
+	}
+
+	job := NewJob{
+		Kind:    PushFinishedJob,
+		Key:     pushFinishedKey(key),
+		Payload: string(payload),
+		RunAt:   time.UnixMilli(finishesAt),
+	}
+	if _, err := enqueueJob(tx, job, now, replaceJob); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetVAPID returns the key and subject the server identifies itself to push
+// services with.
+func GetVAPID() (webpush.VAPID, error) {
+	var encodedKey, subject string
+	err := db.QueryRow(`SELECT private_key, subject FROM vapid_keys ORDER BY id DESC LIMIT 1`).Scan(&encodedKey, &subject)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return webpush.VAPID{}, NoVAPIDKeys
+		}
+		log.Println(err)
+		return webpush.VAPID{}, InternalServerError
+	}
+
+	key, err := webpush.ParseKey(encodedKey)
+	if err != nil {
+		log.Println(err)
+		return webpush.VAPID{}, InternalServerError
+	}
+
+	return webpush.VAPID{PrivateKey: key, Subject: subject}, nil
+}
+
+// SetVAPID replaces the VAPID key. Browsers subscribed with the old key can't
+// be reached with the new one, so their subscriptions are deleted.
+func SetVAPID(vapid webpush.VAPID) error {
+	encodedKey, err := webpush.MarshalKey(vapid.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		`DELETE FROM vapid_keys`,
+		`DELETE FROM push_subscriptions`,
+		`DELETE FROM push_notifications`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	query := `INSERT INTO vapid_keys (private_key, subject, created_at) VALUES (?, ?, ?)`
+	if _, err := tx.Exec(query, encodedKey, vapid.Subject, time.Now().UnixMilli()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SavePushSubscription stores the push subscription of a device of the user.
+// Subscribing an endpoint again updates it, even if it belonged to another
+// user before.
+func SavePushSubscription(userID UserID, device string, subscription webpush.Subscription) (PushSubscription, error) {
+	if err := subscription.Validate(); err != nil {
+		return PushSubscription{}, err
+	}
+
+	saved := PushSubscription{Device: device, Endpoint: subscription.Endpoint}
+	var createdAt int64
+
+	query := `INSERT INTO push_subscriptions (user_id, device, endpoint, p256dh, auth, created_at) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (endpoint) DO UPDATE SET
+  user_id = excluded.user_id, device = excluded.device, p256dh = excluded.p256dh, auth = excluded.auth, created_at = excluded.created_at
+RETURNING id, created_at`
+	err := db.QueryRow(
+		query, userID, device, subscription.Endpoint, subscription.Keys.P256dh,
+		subscription.Keys.Auth, time.Now().UnixMilli(),
+	).Scan(&saved.ID, &createdAt)
+	if err != nil {
+		log.Println(err)
+		return PushSubscription{}, InternalServerError
+	}
+	saved.CreatedAt = time.UnixMilli(createdAt).UTC()
+
+	return saved, nil
+}
+
+func ListPushSubscriptions(userID UserID) ([]PushSubscription, error) {
+	query := `SELECT id, device, endpoint, created_at FROM push_subscriptions WHERE user_id = ? ORDER BY id`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	subscriptions := []PushSubscription{}
+	for rows.Next() {
+		var subscription PushSubscription
+		var createdAt int64
+		if err := rows.Scan(&subscription.ID, &subscription.Device, &subscription.Endpoint, &createdAt); err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		subscription.CreatedAt = time.UnixMilli(createdAt).UTC()
+		subscriptions = append(subscriptions, subscription)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return subscriptions, nil
+}
+
+func DeletePushSubscription(userID UserID, id int64) error {
+	result, err := db.Exec(`DELETE FROM push_subscriptions WHERE user_id = ? AND id = ?`, userID, id)
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+	if deleted == 0 {
+		return NoSuchPushSubscription
+	}
+
+	return nil
+}
+
+// ForgetPushEndpoint deletes a subscription the push service no longer
+// knows.
+func ForgetPushEndpoint(endpoint string) error {
+	if _, err := db.Exec(`DELETE FROM push_subscriptions WHERE endpoint = ?`, endpoint); err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+	return nil
+}
+
+// PushTargets returns the push subscriptions of the user with their keys.
+func PushTargets(userID UserID) ([]webpush.Subscription, error) {
+	rows, err := db.Query(`SELECT endpoint, p256dh, auth FROM push_subscriptions WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	var subscriptions []webpush.Subscription
+	for rows.Next() {
+		var subscription webpush.Subscription
+		if err := rows.Scan(&subscription.Endpoint, &subscription.Keys.P256dh, &subscription.Keys.Auth); err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return subscriptions, nil
+}
+
+// QueueFinishedPushes queues the push jobs of the running timers that have
+// none, such as those written before push jobs existed. It runs at startup.
+func QueueFinishedPushes(now time.Time) error {
+	query := `SELECT states.user_id, states.timer_id, states.state, states.revision, state_history.created_at
+FROM states
+JOIN state_history ON state_history.user_id = states.user_id
+  AND state_history.timer_id = states.timer_id AND state_history.revision = states.revision
+LEFT JOIN push_notifications ON push_notifications.user_id = states.user_id
+  AND push_notifications.timer_id = states.timer_id
+WHERE (push_notifications.revision IS NULL OR push_notifications.revision != states.revision)
+  AND NOT EXISTS (
+    SELECT 1 FROM jobs WHERE jobs.kind = ? AND jobs.key = states.user_id || '/' || states.timer_id AND jobs.status IN (?, ?)
+  )`
+	rows, err := db.Query(query, PushFinishedJob, JobPending, JobRunning)
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+	defer rows.Close()
+
+	var jobs []NewJob
+	for rows.Next() {
+		var payload PushFinishedPayload
+		var stateString string
+		var writtenAt int64
+		if err := rows.Scan(&payload.UserID, &payload.TimerID, &stateString, &payload.Revision, &writtenAt); err != nil {
+			log.Println(err)
+			return InternalServerError
+		}
+
+		_, finishesAt, ok := finishing(stateString, writtenAt)
+		if !ok {
+			continue
+		}
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, NewJob{
+			Kind:    PushFinishedJob,
+			Key:     pushFinishedKey(StateKey{UserID: payload.UserID, TimerID: payload.TimerID}),
+			Payload: string(encoded),
+			RunAt:   time.UnixMilli(finishesAt),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+	rows.Close()
+
+	for _, job := range jobs {
+		if err := EnsureJob(job, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FinishingTimer is a stored timer that was running when it was written and
+// will finish, or has finished, by itself.
+type FinishingTimer struct {
+	Key        StateKey
+	Timer      string
+	Revision   Revision
+	State      timer.Timer
+	FinishesAt time.Time
+}
+
+// FinishedTimer returns the timer of a push job, unless it was written again
+// since the job was queued or the user was already notified about it.
+func FinishedTimer(payload PushFinishedPayload) (FinishingTimer, bool, error) {
+	finished := FinishingTimer{
+		Key:      StateKey{UserID: payload.UserID, TimerID: payload.TimerID},
+		Revision: payload.Revision,
+	}
+
+	query := `SELECT timers.name, states.state, state_history.created_at
+FROM states
+JOIN timers ON timers.id = states.timer_id
+JOIN state_history ON state_history.user_id = states.user_id
+  AND state_history.timer_id = states.timer_id AND state_history.revision = states.revision
+LEFT JOIN push_notifications ON push_notifications.user_id = states.user_id
+  AND push_notifications.timer_id = states.timer_id
+WHERE states.user_id = ? AND states.timer_id = ? AND states.revision = ?
+  AND (push_notifications.revision IS NULL OR push_notifications.revision != states.revision)`
+	var stateString string
+	var writtenAt int64
+	err := db.QueryRow(query, payload.UserID, payload.TimerID, payload.Revision).Scan(&finished.Timer, &stateString, &writtenAt)
+	if err == sql.ErrNoRows {
+		return FinishingTimer{}, false, nil
+	}
+	if err != nil {
+		log.Println(err)
+		return FinishingTimer{}, false, InternalServerError
+	}
+
+	state, finishesAt, ok := finishing(stateString, writtenAt)
+	if !ok {
+		return FinishingTimer{}, false, nil
+	}
+	finished.State = state
+	finished.FinishesAt = time.UnixMilli(finishesAt).UTC()
+	return finished, true, nil
+}
+
+// MarkPushNotified records that the user was notified about the revision of
+// a timer, so that it isn't notified again.
+func MarkPushNotified(key StateKey, revision Revision, at time.Time) error {
+	query := `INSERT INTO push_notifications (user_id, timer_id, revision, notified_at) VALUES (?, ?, ?, ?)
+ON CONFLICT (user_id, timer_id) DO UPDATE SET revision = excluded.revision, notified_at = excluded.notified_at`
+	if _, err := db.Exec(query, key.UserID, key.TimerID, revision, at.UnixMilli()); err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+	return nil
+}
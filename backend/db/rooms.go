@@ -0,0 +1,602 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	NoSuchRoom      = errors.New("no such room")
+	NoSuchUser      = errors.New("no such user")
+	NoSuchMember    = errors.New("no such room member")
+	RoomExists      = errors.New("the timer is already shared in a room")
+	InvalidRoomName = errors.New("invalid room name")
+	InvalidRoomRole = errors.New("invalid room role")
+	Forbidden       = errors.New("forbidden")
+)
+
+const maxRoomNameLength = 64
+
+type RoomID = int64
+
+// RoomRole decides what a member may do in a room. Owners and controllers may
+// change the shared timer; viewers only follow it.
+type RoomRole string
+
+const (
+	RoomOwner      RoomRole = "owner"
+	RoomController RoomRole = "controller"
+	RoomViewer     RoomRole = "viewer"
+)
+
+func ParseRoomRole(value string) (RoomRole, error) {
+	switch role := RoomRole(value); role {
+	case RoomController, RoomViewer:
+		return role, nil
+	default:
+		return "", fmt.Errorf("%w: it must be %s or %s", InvalidRoomRole, RoomController, RoomViewer)
+	}
+}
+
+func (role RoomRole) CanControl() bool {
+	return role == RoomOwner || role == RoomController
+}
+
+// Room shares one timer of its owner with the members. Role is the role of
+// the user the room was read for.
+type Room struct {
+	ID        RoomID    `json:"id"`
+	Name      string    `json:"name"`
+	OwnerID   UserID    `json:"-"`
+	Owner     string    `json:"owner"`
+	TimerID   TimerID   `json:"-"`
+	Timer     string    `json:"timer"`
+	Role      RoomRole  `json:"role,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type RoomMember struct {
+	UserID   UserID    `json:"-"`
+	Username string    `json:"username"`
+	Role     RoomRole  `json:"role"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// Key is the state key of the shared timer.
+func (room Room) Key() StateKey {
+	return StateKey{UserID: room.OwnerID, TimerID: room.TimerID}
+}
+
+func validateRoomName(name string) error {
+	if name == "" || len(name) > maxRoomNameLength || !utf8.ValidString(name) {
+		return fmt.Errorf("%w: it must be 1 to %d bytes long", InvalidRoomName, maxRoomNameLength)
+	}
+
+	if strings.ContainsFunc(name, unicode.IsControl) {
+		return fmt.Errorf("%w: it can't contain control characters", InvalidRoomName)
+	}
+
+	return nil
+}
+
+func userIDByName(username string) (UserID, error) {
+	var userID UserID
+
+	query := `SELECT id FROM users WHERE username = ?`
+	if err := db.QueryRow(query, username).Scan(&userID); err != nil {
+		if err == sql.ErrNoRows {
+			return -1, NoSuchUser
+		}
+		log.Println(err)
+		return -1, InternalServerError
+	}
+
+	return userID, nil
+}
+
+const roomQuery = `SELECT rooms.id, rooms.name, rooms.owner_id, users.username, rooms.timer_id, timers.name, rooms.created_at, room_members.role
+FROM rooms
+JOIN users ON users.id = rooms.owner_id
+JOIN timers ON timers.id = rooms.timer_id
+JOIN room_members ON room_members.room_id = rooms.id`
+
+func scanRoom(scanner interface{ Scan(...any) error }) (Room, error) {
+	var room Room
+	var createdAt int64
+
+	if err := scanner.Scan(
+		&room.ID, &room.Name, &room.OwnerID, &room.Owner,
+		&room.TimerID, &room.Timer, &createdAt, &room.Role,
+	); err != nil {
+		return Room{}, err
+	}
+	room.CreatedAt = time.UnixMilli(createdAt).UTC()
+
+	return room, nil
+}
+
+func queryRooms(query string, args ...any) ([]Room, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	rooms := []Room{}
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		rooms = append(rooms, room)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return rooms, nil
+}
+
+// GetRoom returns the room as seen by one of its members. Rooms the user isn't
+// a member of don't exist for them.
+func GetRoom(userID UserID, roomID RoomID) (Room, error) {
+	query := roomQuery + ` WHERE rooms.id = ? AND room_members.user_id = ?`
+	room, err := scanRoom(db.QueryRow(query, roomID, userID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Room{}, NoSuchRoom
+		}
+		log.Println(err)
+		return Room{}, InternalServerError
+	}
+
+	return room, nil
+}
+
+// ListRooms returns the rooms the user is a member of.
+func ListRooms(userID UserID) ([]Room, error) {
+	return queryRooms(roomQuery+` WHERE room_members.user_id = ? ORDER BY rooms.id`, userID)
+}
+
+func listAllRooms() ([]Room, error) {
+	return queryRooms(roomQuery + ` WHERE room_members.role = 'owner' ORDER BY rooms.id`)
+}
+
+// CreateRoom shares a timer of the owner in a new room.
+func CreateRoom(ownerID UserID, name string, timerName string) (Room, error) {
+	if err := validateRoomName(name); err != nil {
+		return Room{}, err
+	}
+
+	timer, err := GetTimer(ownerID, timerName)
+	if err != nil {
+		return Room{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return Room{}, InternalServerError
+	}
+	defer tx.Rollback()
+
+	var existing RoomID
+	err = tx.QueryRow(`SELECT id FROM rooms WHERE timer_id = ?`, timer.ID).Scan(&existing)
+	if err == nil {
+		return Room{}, RoomExists
+	} else if err != sql.ErrNoRows {
+		log.Println(err)
+		return Room{}, InternalServerError
+	}
+
+	now := time.Now().UnixMilli()
+	query := `INSERT INTO rooms (name, owner_id, timer_id, created_at) VALUES (?, ?, ?, ?)`
+	result, err := tx.Exec(query, name, ownerID, timer.ID, now)
+	if err != nil {
+		log.Println(err)
+		return Room{}, InternalServerError
+	}
+
+	roomID, err := result.LastInsertId()
+	if err != nil {
+		log.Println(err)
+		return Room{}, InternalServerError
+	}
+
+	query = `INSERT INTO room_members (room_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)`
+	if _, err := tx.Exec(query, roomID, ownerID, RoomOwner, now); err != nil {
+		log.Println(err)
+		return Room{}, InternalServerError
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return Room{}, InternalServerError
+	}
+
+	return GetRoom(ownerID, roomID)
+}
+
+// ownedRoom returns the room if the user owns it.
+func ownedRoom(userID UserID, roomID RoomID) (Room, error) {
+	room, err := GetRoom(userID, roomID)
+	if err != nil {
+		return Room{}, err
+	}
+
+	if room.Role != RoomOwner {
+		return Room{}, fmt.Errorf("%w: only the owner can manage the room", Forbidden)
+	}
+
+	return room, nil
+}
+
+func deleteRooms(tx *sql.Tx, condition string, args ...any) error {
+	queries := []string{
+		`DELETE FROM room_members WHERE room_id IN (SELECT id FROM rooms WHERE ` + condition + `)`,
+		`DELETE FROM rooms WHERE ` + condition,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deleteRoom(roomID RoomID) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+	defer tx.Rollback()
+
+	if err := deleteRooms(tx, `id = ?`, roomID); err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+
+	return nil
+}
+
+// DeleteRoom stops sharing the timer. The timer and its state stay with the
+// owner.
+func DeleteRoom(userID UserID, roomID RoomID) (Room, error) {
+	room, err := ownedRoom(userID, roomID)
+	if err != nil {
+		return Room{}, err
+	}
+
+	if err := deleteRoom(roomID); err != nil {
+		return Room{}, err
+	}
+
+	return room, nil
+}
+
+func RoomMembers(userID UserID, roomID RoomID) ([]RoomMember, error) {
+	if _, err := GetRoom(userID, roomID); err != nil {
+		return nil, err
+	}
+
+	return roomMembers(roomID)
+}
+
+func roomMembers(roomID RoomID) ([]RoomMember, error) {
+	query := `SELECT users.id, users.username, room_members.role, room_members.joined_at
+FROM room_members JOIN users ON users.id = room_members.user_id
+WHERE room_members.room_id = ? ORDER BY room_members.joined_at, users.username`
+	rows, err := db.Query(query, roomID)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	members := []RoomMember{}
+	for rows.Next() {
+		var member RoomMember
+		var joinedAt int64
+		if err := rows.Scan(&member.UserID, &member.Username, &member.Role, &joinedAt); err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		member.JoinedAt = time.UnixMilli(joinedAt).UTC()
+		members = append(members, member)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return members, nil
+}
+
+// memberIDByName looks up a user named by a room member or owner. Unknown users
+// are reported like non-members, so that rooms can't be used to probe which
+// usernames exist.
+func memberIDByName(username string) (UserID, error) {
+	memberID, err := userIDByName(username)
+	if errors.Is(err, NoSuchUser) {
+		return -1, NoSuchMember
+	}
+	return memberID, err
+}
+
+// setRoomMember adds a member or changes its role. The owner keeps its role.
+func setRoomMember(room Room, username string, role RoomRole) (RoomMember, error) {
+	memberID, err := memberIDByName(username)
+	if err != nil {
+		return RoomMember{}, err
+	}
+
+	if memberID == room.OwnerID {
+		return RoomMember{}, fmt.Errorf("%w: the owner's role can't be changed", Forbidden)
+	}
+
+	member := RoomMember{
+		UserID:   memberID,
+		Username: username,
+		Role:     role,
+		JoinedAt: time.UnixMilli(time.Now().UnixMilli()).UTC(),
+	}
+
+	query := `INSERT INTO room_members (room_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)
+ON CONFLICT (room_id, user_id) DO UPDATE SET role = excluded.role
+RETURNING joined_at`
+	var joinedAt int64
+	if err := db.QueryRow(query, room.ID, memberID, role, member.JoinedAt.UnixMilli()).Scan(&joinedAt); err != nil {
+		log.Println(err)
+		return RoomMember{}, InternalServerError
+	}
+	member.JoinedAt = time.UnixMilli(joinedAt).UTC()
+
+	return member, nil
+}
+
+// SetRoomMember adds a member to a room of the user or changes its role.
+func SetRoomMember(userID UserID, roomID RoomID, username string, role RoomRole) (RoomMember, error) {
+	room, err := ownedRoom(userID, roomID)
+	if err != nil {
+		return RoomMember{}, err
+	}
+
+	return setRoomMember(room, username, role)
+}
+
+func removeRoomMember(room Room, username string) (RoomMember, error) {
+	memberID, err := memberIDByName(username)
+	if err != nil {
+		return RoomMember{}, err
+	}
+
+	if memberID == room.OwnerID {
+		return RoomMember{}, fmt.Errorf("%w: the owner can't leave the room, only delete it", Forbidden)
+	}
+
+	var member RoomMember
+	var joinedAt int64
+	query := `DELETE FROM room_members WHERE room_id = ? AND user_id = ? RETURNING role, joined_at`
+	if err := db.QueryRow(query, room.ID, memberID).Scan(&member.Role, &joinedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return RoomMember{}, NoSuchMember
+		}
+		log.Println(err)
+		return RoomMember{}, InternalServerError
+	}
+	member.UserID = memberID
+	member.Username = username
+	member.JoinedAt = time.UnixMilli(joinedAt).UTC()
+
+	return member, nil
+}
+
+// RemoveRoomMember removes a member from a room. The owner can remove anyone
+// else; other members can only leave.
+func RemoveRoomMember(userID UserID, roomID RoomID, username string) (RoomMember, error) {
+	room, err := GetRoom(userID, roomID)
+	if err != nil {
+		return RoomMember{}, err
+	}
+
+	if room.Role != RoomOwner {
+		memberID, err := memberIDByName(username)
+		if err != nil && !errors.Is(err, NoSuchMember) {
+			return RoomMember{}, err
+		}
+		if err != nil || memberID != userID {
+			return RoomMember{}, fmt.Errorf("%w: only the owner can remove other members", Forbidden)
+		}
+	}
+
+	return removeRoomMember(room, username)
+}
+
+// CanControlRoom reports whether the user may change the shared timer of the
+// room, with the role it has right now.
+func CanControlRoom(userID UserID, roomID RoomID) error {
+	room, err := GetRoom(userID, roomID)
+	if err != nil {
+		return err
+	}
+
+	if !room.Role.CanControl() {
+		return fmt.Errorf("%w: viewers can't change the room timer", Forbidden)
+	}
+
+	return nil
+}
+
+func printRooms(rooms []Room) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tNAME\tOWNER\tTIMER\tCREATED")
+	for _, room := range rooms {
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\n", room.ID, room.Name, room.Owner, room.Timer, room.CreatedAt.Format(time.RFC3339))
+	}
+	writer.Flush()
+}
+
+func printRoomMembers(members []RoomMember) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "USERNAME\tROLE\tJOINED")
+	for _, member := range members {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", member.Username, member.Role, member.JoinedAt.Format(time.RFC3339))
+	}
+	writer.Flush()
+}
+
+// roomByID reads a room for the administrator, who isn't a member.
+func roomByID(value string) (Room, error) {
+	roomID, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return Room{}, fmt.Errorf("invalid room id: %s", value)
+	}
+
+	var ownerID UserID
+	query := `SELECT owner_id FROM rooms WHERE id = ?`
+	if err := db.QueryRow(query, roomID).Scan(&ownerID); err != nil {
+		if err == sql.ErrNoRows {
+			return Room{}, NoSuchRoom
+		}
+		return Room{}, err
+	}
+
+	return GetRoom(ownerID, roomID)
+}
+
+func RoomsCmd(args []string, path string) error {
+	flagSet := flag.NewFlagSet("flowey db rooms", flag.ExitOnError)
+	role := flagSet.String("role", string(RoomViewer), "role of an added member: controller or viewer")
+
+	flagSet.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage: flowey db rooms [OPTIONS] COMMAND
+  list [USERNAME]            list all rooms, or those of a user
+  create OWNER TIMER NAME    share a timer of OWNER in a new room
+  delete ROOM                delete a room
+  members ROOM               list the members of a room
+  add ROOM USERNAME          add a member or change its role
+  remove ROOM USERNAME       remove a member`)
+		fmt.Fprintln(os.Stderr)
+		flagSet.PrintDefaults()
+	}
+
+	flagSet.Parse(args)
+
+	arities := map[string][]int{
+		"list":    {1, 2},
+		"create":  {4},
+		"delete":  {2},
+		"members": {2},
+		"add":     {3},
+		"remove":  {3},
+	}
+	if arity, ok := arities[flagSet.Arg(0)]; !ok || !slices.Contains(arity, flagSet.NArg()) {
+		flagSet.Usage()
+		return nil
+	}
+
+	memberRole, err := ParseRoomRole(*role)
+	if err != nil {
+		return err
+	}
+
+	if err := Prepare(path); err != nil {
+		log.Fatal(err)
+	}
+	defer Close()
+
+	switch flagSet.Arg(0) {
+	case "list":
+		if flagSet.NArg() == 1 {
+			rooms, err := listAllRooms()
+			if err != nil {
+				return err
+			}
+			printRooms(rooms)
+			return nil
+		}
+
+		userID, err := userIDByName(flagSet.Arg(1))
+		if err != nil {
+			return err
+		}
+		rooms, err := ListRooms(userID)
+		if err != nil {
+			return err
+		}
+		printRooms(rooms)
+	case "create":
+		ownerID, err := userIDByName(flagSet.Arg(1))
+		if err != nil {
+			return err
+		}
+		room, err := CreateRoom(ownerID, flagSet.Arg(3), flagSet.Arg(2))
+		if err != nil {
+			return err
+		}
+		printRooms([]Room{room})
+	case "delete":
+		room, err := roomByID(flagSet.Arg(1))
+		if err != nil {
+			return err
+		}
+		if err := deleteRoom(room.ID); err != nil {
+			return err
+		}
+		log.Printf("deleted room %d", room.ID)
+	case "members":
+		room, err := roomByID(flagSet.Arg(1))
+		if err != nil {
+			return err
+		}
+		members, err := roomMembers(room.ID)
+		if err != nil {
+			return err
+		}
+		printRoomMembers(members)
+	case "add":
+		room, err := roomByID(flagSet.Arg(1))
+		if err != nil {
+			return err
+		}
+		member, err := setRoomMember(room, flagSet.Arg(2), memberRole)
+		if err != nil {
+			return err
+		}
+		printRoomMembers([]RoomMember{member})
+	case "remove":
+		room, err := roomByID(flagSet.Arg(1))
+		if err != nil {
+			return err
+		}
+		if _, err := removeRoomMember(room, flagSet.Arg(2)); err != nil {
+			return err
+		}
+		log.Printf("removed %s from room %d", flagSet.Arg(2), room.ID)
+	}
+
+	return nil
+}
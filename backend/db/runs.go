@@ -0,0 +1,286 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"flowey/timer"
+)
+
+var InvalidRange = errors.New("invalid range")
+
+// FocusRun is a run of a timer from when it was started to when it was
+// stopped or finished by itself. ReverseMs is the time it spent reversed.
+// EndedAt is nil while the run goes on.
+type FocusRun struct {
+	ID           int64      `json:"id"`
+	Timer        string     `json:"timer"`
+	StartedAt    time.Time  `json:"startedAt"`
+	EndedAt      *time.Time `json:"endedAt,omitempty"`
+	MaxTime      int64      `json:"maxTime"`
+	Buff         float64    `json:"buff"`
+	ReverseMs    int64      `json:"reverseMs"`
+	StoppedEarly bool       `json:"stoppedEarly"`
+
+	finishesAt int64
+	reversedAt sql.NullInt64
+}
+
+// end returns when the run ended or, if it goes on, the earlier of now and
+// when it's due to finish.
+func (run FocusRun) end(now time.Time) time.Time {
+	if run.EndedAt != nil {
+		return *run.EndedAt
+	}
+	return time.UnixMilli(min(now.UnixMilli(), run.finishesAt)).UTC()
+}
+
+// reverse returns the time the run spent reversed until end.
+func (run FocusRun) reverse(end time.Time) int64 {
+	reverseMs := run.ReverseMs
+	if run.reversedAt.Valid {
+		reverseMs += max(end.UnixMilli()-run.reversedAt.Int64, 0)
+	}
+	return reverseMs
+}
+
+// running tells whether a timer counts at now. A reversed timer stays on once
+// it reached the maximum time, but its run is over.
+func running(parsed timer.Timer, isTimer bool, now int64) bool {
+	return isTimer && parsed.IsOn(now) && float64(now) < parsed.FinishesAt()
+}
+
+// recordRun keeps the focus run log of a timer up to date with a state write,
+// in the transaction of the write. A run starts when the timer starts and
+// ends when it's stopped or, noticed at the next write, when it finished by
+// itself.
+func recordRun(tx *sql.Tx, key StateKey, previousStateString string, stateString string) error {
+	nowMs := time.Now().UnixMilli()
+	previous, wasTimer := parseTimer(previousStateString)
+	next, isTimer := parseTimer(stateString)
+	wasOn := running(previous, wasTimer, nowMs)
+	isOn := running(next, isTimer, nowMs)
+
+	var runID, finishesAt int64
+	var reversedAt sql.NullInt64
+	query := `SELECT id, finishes_at, reversed_at FROM focus_runs WHERE user_id = ? AND timer_id = ? AND ended_at IS NULL`
+	err := tx.QueryRow(query, key.UserID, key.TimerID).Scan(&runID, &finishesAt, &reversedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	open := err == nil
+
+	if open && (!wasOn || !isOn || nowMs >= finishesAt) {
+		endedAt := min(nowMs, finishesAt)
+		stoppedEarly := wasOn && nowMs < finishesAt
+		reverseMs := int64(0)
+		if reversedAt.Valid {
+			reverseMs = max(endedAt-reversedAt.Int64, 0)
+		}
+
+		query := `UPDATE focus_runs SET ended_at = ?, reverse_ms = reverse_ms + ?, reversed_at = NULL, stopped_early = ? WHERE id = ?`
+		if _, err := tx.Exec(query, endedAt, reverseMs, stoppedEarly, runID); err != nil {
+			return err
+		}
+		open = false
+	} else if open {
+		reverseMs := int64(0)
+		switch {
+		case next.IsReverseOn && !reversedAt.Valid:
+			reversedAt = sql.NullInt64{Int64: nowMs, Valid: true}
+		case !next.IsReverseOn && reversedAt.Valid:
+			reverseMs = max(nowMs-reversedAt.Int64, 0)
+			reversedAt = sql.NullInt64{}
+		}
+
+		query := `UPDATE focus_runs SET finishes_at = ?, buff = ?, reverse_ms = reverse_ms + ?, reversed_at = ? WHERE id = ?`
+		if _, err := tx.Exec(query, int64(next.FinishesAt()), next.Buff, reverseMs, reversedAt, runID); err != nil {
+			return err
+		}
+	}
+
+	if !open && !wasOn && isOn {
+		return startRun(tx, key, next, nowMs)
+	}
+	return nil
+}
+
+func startRun(tx *sql.Tx, key StateKey, next timer.Timer, nowMs int64) error {
+	reversedAt := sql.NullInt64{Int64: nowMs, Valid: next.IsReverseOn}
+
+	query := `INSERT INTO focus_runs (user_id, timer_id, started_at, finishes_at, max_time, buff, reverse_ms, reversed_at, stopped_early)
+VALUES (?, ?, ?, ?, ?, ?, 0, ?, FALSE)`
+	_, err := tx.Exec(query, key.UserID, key.TimerID, nowMs, int64(next.FinishesAt()), next.MaxTime, next.Buff, reversedAt)
+	return err
+}
+
+// ListRuns returns the focus runs of the user that overlap [from, to), oldest
+// first, optionally only those of one timer. Runs that go on are ended at now
+// or when they're due to finish.
+func ListRuns(userID UserID, timerName string, from time.Time, to time.Time, now time.Time) ([]FocusRun, error) {
+	query := `SELECT focus_runs.id, timers.name, focus_runs.started_at, focus_runs.ended_at, focus_runs.finishes_at,
+  focus_runs.max_time, focus_runs.buff, focus_runs.reverse_ms, focus_runs.reversed_at, focus_runs.stopped_early
+FROM focus_runs JOIN timers ON timers.id = focus_runs.timer_id
+WHERE focus_runs.user_id = ? AND (? = '' OR timers.name = ?)
+  AND focus_runs.started_at < ? AND COALESCE(focus_runs.ended_at, focus_runs.finishes_at) > ?
+ORDER BY focus_runs.started_at, focus_runs.id`
+	rows, err := db.Query(query, userID, timerName, timerName, to.UnixMilli(), from.UnixMilli())
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	runs := []FocusRun{}
+	for rows.Next() {
+		var run FocusRun
+		var startedAt int64
+		var endedAt sql.NullInt64
+		if err := rows.Scan(
+			&run.ID, &run.Timer, &startedAt, &endedAt, &run.finishesAt,
+			&run.MaxTime, &run.Buff, &run.ReverseMs, &run.reversedAt, &run.StoppedEarly,
+		); err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+
+		run.StartedAt = time.UnixMilli(startedAt).UTC()
+		if endedAt.Valid {
+			at := time.UnixMilli(endedAt.Int64).UTC()
+			run.EndedAt = &at
+		}
+		if run.EndedAt == nil && run.end(now).UnixMilli() >= run.finishesAt {
+			// It finished by itself and nothing was written since.
+			at := run.end(now)
+			run.EndedAt = &at
+		}
+		run.ReverseMs = run.reverse(run.end(now))
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return runs, nil
+}
+
+// RunTotals sums up the focus runs of a period. Time is split between the
+// periods a run spans; the run itself, its reverse time and whether it was
+// stopped early count in the period it started in.
+type RunTotals struct {
+	Start        string `json:"start"`
+	FocusMs      int64  `json:"focusMs"`
+	ReverseMs    int64  `json:"reverseMs"`
+	Runs         int    `json:"runs"`
+	StoppedEarly int    `json:"stoppedEarly"`
+}
+
+type RunStats struct {
+	Timezone string      `json:"timezone"`
+	From     string      `json:"from"`
+	To       string      `json:"to"`
+	Daily    []RunTotals `json:"daily"`
+	Weekly   []RunTotals `json:"weekly"`
+	Monthly  []RunTotals `json:"monthly"`
+}
+
+const (
+	dateLayout   = "2006-01-02"
+	MaxStatsDays = 366
+)
+
+// period finds the start of the period containing a time and the start of
+// the next one.
+type period func(at time.Time) (start time.Time, next time.Time)
+
+func day(at time.Time) (time.Time, time.Time) {
+	start := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, at.Location())
+	return start, start.AddDate(0, 0, 1)
+}
+
+// week starts on Monday.
+func week(at time.Time) (time.Time, time.Time) {
+	start, _ := day(at)
+	start = start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+	return start, start.AddDate(0, 0, 7)
+}
+
+func month(at time.Time) (time.Time, time.Time) {
+	start := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, at.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+// totals sums up the runs in every period between from and to.
+func totals(runs []FocusRun, period period, from time.Time, to time.Time, now time.Time) []RunTotals {
+	var periods []RunTotals
+	index := make(map[string]int)
+	for start, _ := period(from); start.Before(to); _, start = period(start) {
+		index[start.Format(dateLayout)] = len(periods)
+		periods = append(periods, RunTotals{Start: start.Format(dateLayout)})
+	}
+
+	for _, run := range runs {
+		startedAt := run.StartedAt.In(from.Location())
+		endedAt := run.end(now).In(from.Location())
+
+		if !startedAt.Before(from) && startedAt.Before(to) {
+			start, _ := period(startedAt)
+			totals := &periods[index[start.Format(dateLayout)]]
+			totals.Runs++
+			totals.ReverseMs += run.ReverseMs
+			if run.StoppedEarly {
+				totals.StoppedEarly++
+			}
+		}
+
+		for at := maxTime(startedAt, from); at.Before(endedAt) && at.Before(to); {
+			start, next := period(at)
+			end := minTime(minTime(next, endedAt), to)
+			periods[index[start.Format(dateLayout)]].FocusMs += end.Sub(at).Milliseconds()
+			at = end
+		}
+	}
+
+	return periods
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Stats sums up the focus runs of the user, or of one of its timers, by day,
+// week and month between the dates from and to, inclusive, in the location.
+func Stats(userID UserID, timerName string, location *time.Location, from time.Time, to time.Time, now time.Time) (RunStats, error) {
+	from, _ = day(from.In(location))
+	_, end := day(to.In(location))
+	if !from.Before(end) || end.Sub(from) > MaxStatsDays*24*time.Hour+time.Hour {
+		return RunStats{}, InvalidRange
+	}
+
+	runs, err := ListRuns(userID, timerName, from, end, now)
+	if err != nil {
+		return RunStats{}, err
+	}
+
+	return RunStats{
+		Timezone: location.String(),
+		From:     from.Format(dateLayout),
+		To:       to.In(location).Format(dateLayout),
+		Daily:    totals(runs, day, from, end, now),
+		Weekly:   totals(runs, week, from, end, now),
+		Monthly:  totals(runs, month, from, end, now),
+	}, nil
+}
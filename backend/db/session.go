@@ -4,9 +4,12 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -14,6 +17,16 @@ import (
 var (
 	Unathorized         = errors.New("unauthorized")
 	InternalServerError = errors.New("internal server error")
+	NoSuchSession       = errors.New("no such session")
+)
+
+const (
+	maxSessionLabelLength = 64
+	maxUserAgentLength    = 512
+
+	// lastSeenResolution bounds how often authenticating with a session
+	// writes its last seen time.
+	lastSeenResolution = time.Minute
 )
 
 type Credentials struct {
@@ -43,11 +56,32 @@ func AuthenticateByCredentials(credentials Credentials) (int, error) {
 	return userID, nil
 }
 
+// SessionInfo describes where a session was created. Label is chosen by the
+// user to tell its devices apart.
+type SessionInfo struct {
+	Label     string
+	UserAgent string
+	IP        string
+}
+
+// Session is a session as its user sees it. The token itself is never shown;
+// ID names the session instead.
+type Session struct {
+	ID         string    `json:"id"`
+	Label      string    `json:"label"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	Current    bool      `json:"current"`
+}
+
 func AuthenticateBySessionToken(sessionToken string) (int, error) {
 	var userID UserID
+	var lastSeenAt int64
 
-	query := `SELECT user_id FROM sessions WHERE session_token = ?`
-	err := db.QueryRow(query, sessionToken).Scan(&userID)
+	query := `SELECT user_id, last_seen_at FROM sessions WHERE session_token = ?`
+	err := db.QueryRow(query, sessionToken).Scan(&userID, &lastSeenAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return -1, Unathorized
@@ -56,19 +90,64 @@ func AuthenticateBySessionToken(sessionToken string) (int, error) {
 		return -1, InternalServerError
 	}
 
+	now := time.Now()
+	if now.Sub(time.UnixMilli(lastSeenAt)) >= lastSeenResolution {
+		query := `UPDATE sessions SET last_seen_at = ? WHERE session_token = ?`
+		if _, err := db.Exec(query, now.UnixMilli(), sessionToken); err != nil {
+			log.Println(err)
+		}
+	}
+
 	return userID, nil
 }
 
-func CreateSessionToken(userID UserID) (string, error) {
-	byteSessionToken := make([]byte, 40)
-	if _, err := rand.Read(byteSessionToken); err != nil {
+// randomToken returns size random bytes, encoded for use in URLs.
+func randomToken(size int) (string, error) {
+	byteToken := make([]byte, size)
+	if _, err := rand.Read(byteToken); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(byteToken), nil
+}
+
+// randomSessionID makes the ID sessions are listed and revoked by. It's hex,
+// like the IDs existing sessions got when session_infos was added.
+func randomSessionID() (string, error) {
+	byteID := make([]byte, 12)
+	if _, err := rand.Read(byteID); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(byteID), nil
+}
+
+func truncate(value string, maxLength int) string {
+	if len(value) <= maxLength {
+		return value
+	}
+	return strings.ToValidUTF8(value[:maxLength], "")
+}
+
+func CreateSessionToken(userID UserID, info SessionInfo) (string, error) {
+	sessionToken, err := randomToken(40)
+	if err != nil {
 		log.Println(err)
 		return "", fmt.Errorf("failed to create a session token")
 	}
-	sessionToken := base64.RawURLEncoding.EncodeToString(byteSessionToken)
 
-	query := `INSERT INTO sessions (session_token, user_id) VALUES (?, ?)`
-	_, err := db.Exec(query, sessionToken, userID)
+	sessionID, err := randomSessionID()
+	if err != nil {
+		log.Println(err)
+		return "", fmt.Errorf("failed to create a session token")
+	}
+
+	now := time.Now().UnixMilli()
+	query := `INSERT INTO sessions (session_token, user_id, id, label, user_agent, ip, created_at, last_seen_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(
+		query, sessionToken, userID, sessionID,
+		truncate(info.Label, maxSessionLabelLength), truncate(info.UserAgent, maxUserAgentLength), info.IP,
+		now, now,
+	)
 	if err != nil {
 		log.Println(err)
 		return "", fmt.Errorf("failed to store a session token")
@@ -77,6 +156,71 @@ func CreateSessionToken(userID UserID) (string, error) {
 	return sessionToken, nil
 }
 
+// ListSessions returns the sessions of the user, most recently seen first.
+// The one of currentToken is marked as current.
+func ListSessions(userID UserID, currentToken string) ([]Session, error) {
+	query := `SELECT id, label, user_agent, ip, created_at, last_seen_at, session_token = ? FROM sessions
+WHERE user_id = ? ORDER BY last_seen_at DESC, created_at DESC`
+	rows, err := db.Query(query, currentToken, userID)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		var createdAt, lastSeenAt int64
+		if err := rows.Scan(
+			&session.ID, &session.Label, &session.UserAgent, &session.IP,
+			&createdAt, &lastSeenAt, &session.Current,
+		); err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		session.CreatedAt = time.UnixMilli(createdAt).UTC()
+		session.LastSeenAt = time.UnixMilli(lastSeenAt).UTC()
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession deletes a session of the user by its ID. It returns the
+// session token so that the caller can close what's still using it.
+func RevokeSession(userID UserID, sessionID string) (string, error) {
+	var sessionToken string
+
+	query := `DELETE FROM sessions WHERE user_id = ? AND id = ? RETURNING session_token`
+	if err := db.QueryRow(query, userID, sessionID).Scan(&sessionToken); err != nil {
+		if err == sql.ErrNoRows {
+			return "", NoSuchSession
+		}
+		log.Println(err)
+		return "", InternalServerError
+	}
+
+	return sessionToken, nil
+}
+
+// DeleteUserSessions logs the user out everywhere.
+func DeleteUserSessions(userID UserID) error {
+	query := `DELETE FROM sessions WHERE user_id = ?`
+	_, err := db.Exec(query, userID)
+	if err != nil {
+		log.Println(err)
+		return fmt.Errorf("failed to delete the session tokens")
+	}
+
+	return nil
+}
+
 func DeleteSessionToken(sessionToken string) error {
 	query := `DELETE FROM sessions WHERE session_token = ?`
 	_, err := db.Exec(query, sessionToken)
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	NoSuchShare  = errors.New("no such share")
+	InvalidShare = errors.New("invalid share")
+)
+
+const maxShareLabelLength = 256
+
+type ShareID = int64
+
+// Share lets anyone holding its token follow a timer without being able to
+// change it, until it's revoked or expires.
+type Share struct {
+	ID        ShareID    `json:"id"`
+	Token     string     `json:"token"`
+	UserID    UserID     `json:"-"`
+	TimerID   TimerID    `json:"-"`
+	Timer     string     `json:"timer"`
+	Label     string     `json:"label"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+func (share Share) Key() StateKey {
+	return StateKey{UserID: share.UserID, TimerID: share.TimerID}
+}
+
+const shareQuery = `SELECT shares.id, shares.token, shares.user_id, shares.timer_id, timers.name, shares.label, shares.created_at, shares.expires_at
+FROM shares JOIN timers ON timers.id = shares.timer_id`
+
+func scanShare(scanner interface{ Scan(...any) error }) (Share, error) {
+	var share Share
+	var createdAt int64
+	var expiresAt sql.NullInt64
+
+	if err := scanner.Scan(
+		&share.ID, &share.Token, &share.UserID, &share.TimerID,
+		&share.Timer, &share.Label, &createdAt, &expiresAt,
+	); err != nil {
+		return Share{}, err
+	}
+
+	share.CreatedAt = time.UnixMilli(createdAt).UTC()
+	if expiresAt.Valid {
+		at := time.UnixMilli(expiresAt.Int64).UTC()
+		share.ExpiresAt = &at
+	}
+
+	return share, nil
+}
+
+// CreateShare mints a share token for a timer of the user. A nil expiresAt
+// makes a token that lasts until it's revoked.
+func CreateShare(userID UserID, timerName string, label string, expiresAt *time.Time) (Share, error) {
+	if len(label) > maxShareLabelLength {
+		return Share{}, fmt.Errorf("%w: the label is longer than %d bytes", InvalidShare, maxShareLabelLength)
+	}
+
+	now := time.Now()
+	if expiresAt != nil && !expiresAt.After(now) {
+		return Share{}, fmt.Errorf("%w: it would expire in the past", InvalidShare)
+	}
+
+	timer, err := GetTimer(userID, timerName)
+	if err != nil {
+		return Share{}, err
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		log.Println(err)
+		return Share{}, InternalServerError
+	}
+
+	share := Share{
+		Token:     token,
+		UserID:    userID,
+		TimerID:   timer.ID,
+		Timer:     timer.Name,
+		Label:     label,
+		CreatedAt: time.UnixMilli(now.UnixMilli()).UTC(),
+	}
+
+	var expiresAtMs sql.NullInt64
+	if expiresAt != nil {
+		at := time.UnixMilli(expiresAt.UnixMilli()).UTC()
+		share.ExpiresAt = &at
+		expiresAtMs = sql.NullInt64{Int64: at.UnixMilli(), Valid: true}
+	}
+
+	query := `INSERT INTO shares (token, user_id, timer_id, label, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, token, userID, timer.ID, label, share.CreatedAt.UnixMilli(), expiresAtMs)
+	if err != nil {
+		log.Println(err)
+		return Share{}, InternalServerError
+	}
+
+	share.ID, err = result.LastInsertId()
+	if err != nil {
+		log.Println(err)
+		return Share{}, InternalServerError
+	}
+
+	return share, nil
+}
+
+// ListShares returns the shares of the user that haven't expired.
+func ListShares(userID UserID) ([]Share, error) {
+	query := shareQuery + ` WHERE shares.user_id = ? AND (shares.expires_at IS NULL OR shares.expires_at > ?) ORDER BY shares.id`
+	rows, err := db.Query(query, userID, time.Now().UnixMilli())
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		shares = append(shares, share)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return shares, nil
+}
+
+// ShareByToken returns the share a spectator presents, unless it's expired.
+func ShareByToken(token string) (Share, error) {
+	query := shareQuery + ` WHERE shares.token = ?`
+	share, err := scanShare(db.QueryRow(query, token))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Share{}, NoSuchShare
+		}
+		log.Println(err)
+		return Share{}, InternalServerError
+	}
+
+	if share.ExpiresAt != nil && !share.ExpiresAt.After(time.Now()) {
+		return Share{}, NoSuchShare
+	}
+
+	return share, nil
+}
+
+// RevokeShare deletes a share of the user. Expired shares are deleted along
+// the way.
+func RevokeShare(userID UserID, shareID ShareID) (Share, error) {
+	query := shareQuery + ` WHERE shares.id = ? AND shares.user_id = ?`
+	share, err := scanShare(db.QueryRow(query, shareID, userID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Share{}, NoSuchShare
+		}
+		log.Println(err)
+		return Share{}, InternalServerError
+	}
+
+	query = `DELETE FROM shares WHERE user_id = ? AND (id = ? OR expires_at <= ?)`
+	if _, err := db.Exec(query, userID, shareID, time.Now().UnixMilli()); err != nil {
+		log.Println(err)
+		return Share{}, InternalServerError
+	}
+
+	return share, nil
+}
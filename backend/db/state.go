@@ -4,57 +4,70 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"maps"
+	"reflect"
+	"time"
+
+	"flowey/jsonpatch"
+)
+
+var (
+	InvalidState   = errors.New("invalid state")
+	InvalidPatch   = errors.New("invalid patch")
+	PatchConflict  = errors.New("patch conflict")
+	MissingVersion = errors.New("missing version")
 )
 
-type State struct {
-	Version int `json:"version"`
+// versionModulus keeps the version field that legacy clients compare within
+// the range they have always seen. The revision column itself never wraps.
+const versionModulus = 1000000
+
+type Revision = int64
+
+func VersionOf(revision Revision) int {
+	return int(revision % versionModulus)
 }
 
-func GetState(userID UserID) (stateString string, stateVersion int, err error) {
-	query := `SELECT state FROM states WHERE user_id = ?`
-	err = db.QueryRow(query, userID).Scan(&stateString)
+func GetState(key StateKey) (stateString string, stateVersion int, err error) {
+	stateString, revision, err := GetStateRevision(key)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", 0, nil
-		}
-		log.Println(err)
-		return "", 0, InternalServerError
+		return "", 0, err
 	}
 
-	var state State
-	err = json.Unmarshal([]byte(stateString), &state)
+	return stateString, VersionOf(revision), nil
+}
+
+func GetStateRevision(key StateKey) (stateString string, revision Revision, err error) {
+	query := `SELECT state, revision FROM states WHERE user_id = ? AND timer_id = ?`
+	err = db.QueryRow(query, key.UserID, key.TimerID).Scan(&stateString, &revision)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", 0, nil
+		}
 		log.Println(err)
 		return "", 0, InternalServerError
 	}
 
-	stateVersion = state.Version
-	return stateString, stateVersion, nil
+	return stateString, revision, nil
 }
 
-func incrementStateVersion(stateString string) (newStateString string, err error) {
+func withVersion(stateString string, version int) (newStateString string, err error) {
 	decoder := json.NewDecoder(bytes.NewReader([]byte(stateString)))
 	decoder.UseNumber()
 
 	state := make(map[string]interface{})
-	if err := decoder.Decode(&state); err != nil {
-		log.Printf("failed to parse old state: %v", err)
-		return "", InternalServerError
+	if err := decoder.Decode(&state); err != nil || state == nil {
+		return "", InvalidState
 	}
 
-	version, err := state["version"].(json.Number).Int64()
-	if err != nil {
-		return "", err
-	}
-
-	state["version"] = (version + 1) % 1000000
+	state["version"] = version
 
 	newStateBytes, err := json.Marshal(state)
 	if err != nil {
 		log.Printf("failed to marshal new state: %v", err)
-		return "", nil
+		return "", InternalServerError
 	}
 
 	return string(newStateBytes), nil
@@ -72,45 +85,204 @@ func equalStates(clientStateString string, serverStateString string) bool {
 		return false
 	}
 
-	return maps.Equal(clientState, serverState)
+	return reflect.DeepEqual(clientState, serverState)
 }
 
-func ChooseState(userID UserID, clientStateString string) (push bool, stateString string, err error) {
+func parseClientState(clientStateString string) (State, error) {
+	if err := checkStateSize(clientStateString); err != nil {
+		return State{}, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(clientStateString), &fields); err != nil || fields == nil {
+		return State{}, InvalidState
+	}
+
+	if _, ok := fields["version"]; !ok {
+		return State{}, MissingVersion
+	}
+
+	if _, err := validateState(clientStateString); err != nil {
+		return State{}, err
+	}
+
 	var clientState State
 	if err := json.Unmarshal([]byte(clientStateString), &clientState); err != nil {
-		return false, "", err
+		return State{}, InvalidState
+	}
+
+	return clientState, nil
+}
+
+// compareAndSwapState stores the state under the next revision, but only if
+// the stored revision is still the expected one. The new revision is appended
+// to the history and the timer events it causes are queued for webhooks in
+// the same transaction.
+func compareAndSwapState(key StateKey, revision Revision, previousStateString string, stateString string, change change) (swapped bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return false, InternalServerError
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO states (user_id, timer_id, state, revision) VALUES (?, ?, ?, ?)
+ON CONFLICT (user_id, timer_id) DO UPDATE SET state = excluded.state, revision = excluded.revision
+WHERE states.revision = ?`
+	result, err := tx.Exec(query, key.UserID, key.TimerID, stateString, revision+1, revision)
+	if err != nil {
+		log.Println(err)
+		return false, InternalServerError
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		return false, InternalServerError
+	}
+
+	if rowsAffected != 1 {
+		return false, nil
+	}
+
+	if err := appendHistory(tx, key, revision+1, stateString, change); err != nil {
+		log.Println(err)
+		return false, InternalServerError
+	}
+
+	queued, err := queueTimerEvents(tx, key, previousStateString, stateString)
+	if err != nil {
+		log.Println(err)
+		return false, InternalServerError
+	}
+
+	if err := recordRun(tx, key, previousStateString, stateString); err != nil {
+		log.Println(err)
+		return false, InternalServerError
+	}
+
+	pushQueued, err := queueFinishedPush(tx, key, revision+1, stateString, time.Now())
+	if err != nil {
+		log.Println(err)
+		return false, InternalServerError
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return false, InternalServerError
+	}
+	if queued {
+		notifyDeliveries()
+	}
+	if pushQueued {
+		notifyJobs()
+	}
+
+	return true, nil
+}
+
+// writeState stores the client state on top of the given revision. If another
+// writer got there first, it returns the state that won instead.
+func writeState(key StateKey, revision Revision, serverStateString string, clientStateString string, change change) (swapped bool, stateString string, newRevision Revision, err error) {
+	newStateString, err := withClocks(serverStateString, clientStateString)
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	newStateString, err = withVersion(newStateString, VersionOf(revision+1))
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	newStateString, err = validateState(newStateString)
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	swapped, err = compareAndSwapState(key, revision, serverStateString, newStateString, change)
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	if !swapped {
+		stateString, newRevision, err = GetStateRevision(key)
+		return false, stateString, newRevision, err
+	}
+
+	return true, newStateString, revision + 1, nil
+}
+
+func ChooseState(key StateKey, origin string, clientStateString string) (push bool, stateString string, revision Revision, err error) {
+	clientState, err := parseClientState(clientStateString)
+	if err != nil {
+		return false, "", 0, err
 	}
 	clientStateVersion := clientState.Version
 
-	serverStateString, serverStateVersion, err := GetState(userID)
+	serverStateString, serverRevision, err := GetStateRevision(key)
 	if err != nil {
-		return false, "", err
+		return false, "", 0, err
 	}
 
 	if equalStates(clientStateString, serverStateString) {
-		return false, "", nil
+		return false, "", serverRevision, nil
 	}
 
-	if clientStateVersion == serverStateVersion {
-		newClientStateString, err := incrementStateVersion(clientStateString)
-		if err != nil {
-			return false, "", err
-		}
+	if clientState.Clocks != nil {
+		return mergeState(key, origin, serverStateString, serverRevision, clientStateString)
+	}
+
+	if clientStateVersion != VersionOf(serverRevision) {
+		return true, serverStateString, serverRevision, nil
+	}
 
-		SetState(userID, newClientStateString)
-		return true, newClientStateString, nil
-	} else {
-		return true, serverStateString, nil
+	_, stateString, revision, err = writeState(key, serverRevision, serverStateString, clientStateString, change{origin: origin})
+	if err != nil {
+		return false, "", 0, err
 	}
+
+	return true, stateString, revision, nil
 }
 
-func SetState(userID UserID, stateString string) error {
-	query := `INSERT INTO states (user_id, state) VALUES (?, ?) ON CONFLICT (user_id) DO UPDATE SET state = ?`
-	_, err := db.Exec(query, userID, stateString, stateString)
+func ReplaceState(key StateKey, origin string, revision Revision, clientStateString string) (applied bool, stateString string, stateRevision Revision, err error) {
+	serverStateString, serverRevision, err := GetStateRevision(key)
 	if err != nil {
-		log.Println(err)
-		return InternalServerError
+		return false, "", 0, err
+	}
+
+	if revision != serverRevision {
+		return false, serverStateString, serverRevision, nil
+	}
+
+	return writeState(key, serverRevision, serverStateString, clientStateString, change{origin: origin})
+}
+
+// PatchState applies a JSON Patch to the stored state, but only if the state
+// is still at the base revision the patch was made against. A patch whose test
+// fails or whose path is gone is a PatchConflict, returned with the state.
+func PatchState(key StateKey, origin string, base Revision, patch jsonpatch.Patch) (applied bool, stateString string, revision Revision, err error) {
+	serverStateString, serverRevision, err := GetStateRevision(key)
+	if err != nil {
+		return false, "", 0, err
+	}
+
+	if base != serverRevision {
+		return false, serverStateString, serverRevision, nil
+	}
+
+	baseStateString := serverStateString
+	if baseStateString == "" {
+		baseStateString = "{}"
+	}
+
+	patchedState, err := jsonpatch.Apply([]byte(baseStateString), patch)
+	if errors.Is(err, jsonpatch.TestFailed) || errors.Is(err, jsonpatch.PathNotFound) {
+		// Another writer changed what the patch expected; the sender should
+		// rebase on the current state.
+		return false, serverStateString, serverRevision, fmt.Errorf("%w: %v", PatchConflict, err)
+	} else if err != nil {
+		return false, "", 0, fmt.Errorf("%w: %v", InvalidPatch, err)
 	}
 
-	return nil
+	return writeState(key, serverRevision, baseStateString, string(patchedState), change{origin: origin})
 }
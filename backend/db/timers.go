@@ -0,0 +1,233 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	NoSuchTimer      = errors.New("no such timer")
+	TimerExists      = errors.New("a timer with this name already exists")
+	InvalidTimerName = errors.New("invalid timer name")
+	DefaultTimer     = errors.New("the default timer can't be renamed or deleted")
+)
+
+// DefaultTimerName is the timer used when a client doesn't name one. Every
+// user has it; it's created on first use.
+const DefaultTimerName = "default"
+
+const maxTimerNameLength = 64
+
+type TimerID = int64
+
+type Timer struct {
+	ID        TimerID   `json:"id"`
+	UserID    UserID    `json:"-"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// StateKey names the state of one timer. Every state function takes one.
+type StateKey struct {
+	UserID  UserID
+	TimerID TimerID
+}
+
+func (timer Timer) Key() StateKey {
+	return StateKey{UserID: timer.UserID, TimerID: timer.ID}
+}
+
+func validateTimerName(name string) error {
+	if name == "" || len(name) > maxTimerNameLength || !utf8.ValidString(name) {
+		return fmt.Errorf("%w: it must be 1 to %d bytes long", InvalidTimerName, maxTimerNameLength)
+	}
+
+	if strings.ContainsFunc(name, func(r rune) bool { return r == '/' || unicode.IsControl(r) }) {
+		return fmt.Errorf("%w: it can't contain slashes or control characters", InvalidTimerName)
+	}
+
+	return nil
+}
+
+func createDefaultTimer(userID UserID) error {
+	query := `INSERT INTO timers (user_id, name, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`
+	_, err := db.Exec(query, userID, DefaultTimerName, time.Now().UnixMilli())
+	return err
+}
+
+func scanTimer(scanner interface{ Scan(...any) error }) (Timer, error) {
+	var timer Timer
+	var createdAt int64
+
+	if err := scanner.Scan(&timer.ID, &timer.UserID, &timer.Name, &createdAt); err != nil {
+		return Timer{}, err
+	}
+	timer.CreatedAt = time.UnixMilli(createdAt).UTC()
+
+	return timer, nil
+}
+
+func GetTimer(userID UserID, name string) (Timer, error) {
+	if name == DefaultTimerName {
+		if err := createDefaultTimer(userID); err != nil {
+			log.Println(err)
+			return Timer{}, InternalServerError
+		}
+	}
+
+	query := `SELECT id, user_id, name, created_at FROM timers WHERE user_id = ? AND name = ?`
+	timer, err := scanTimer(db.QueryRow(query, userID, name))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Timer{}, NoSuchTimer
+		}
+		log.Println(err)
+		return Timer{}, InternalServerError
+	}
+
+	return timer, nil
+}
+
+func ListTimers(userID UserID) ([]Timer, error) {
+	if err := createDefaultTimer(userID); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	query := `SELECT id, user_id, name, created_at FROM timers WHERE user_id = ? ORDER BY id`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	timers := []Timer{}
+	for rows.Next() {
+		timer, err := scanTimer(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		timers = append(timers, timer)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return timers, nil
+}
+
+func CreateTimer(userID UserID, name string) (Timer, error) {
+	if err := validateTimerName(name); err != nil {
+		return Timer{}, err
+	}
+
+	if _, err := GetTimer(userID, name); err == nil {
+		return Timer{}, TimerExists
+	} else if err != NoSuchTimer {
+		return Timer{}, err
+	}
+
+	timer := Timer{UserID: userID, Name: name, CreatedAt: time.UnixMilli(time.Now().UnixMilli()).UTC()}
+	query := `INSERT INTO timers (user_id, name, created_at) VALUES (?, ?, ?)`
+	result, err := db.Exec(query, userID, name, timer.CreatedAt.UnixMilli())
+	if err != nil {
+		log.Println(err)
+		return Timer{}, InternalServerError
+	}
+
+	timer.ID, err = result.LastInsertId()
+	if err != nil {
+		log.Println(err)
+		return Timer{}, InternalServerError
+	}
+
+	return timer, nil
+}
+
+func RenameTimer(userID UserID, name string, newName string) (Timer, error) {
+	if name == DefaultTimerName || newName == DefaultTimerName {
+		return Timer{}, DefaultTimer
+	}
+
+	if err := validateTimerName(newName); err != nil {
+		return Timer{}, err
+	}
+
+	timer, err := GetTimer(userID, name)
+	if err != nil {
+		return Timer{}, err
+	}
+
+	if _, err := GetTimer(userID, newName); err == nil {
+		return Timer{}, TimerExists
+	} else if err != NoSuchTimer {
+		return Timer{}, err
+	}
+
+	query := `UPDATE timers SET name = ? WHERE id = ?`
+	if _, err := db.Exec(query, newName, timer.ID); err != nil {
+		log.Println(err)
+		return Timer{}, InternalServerError
+	}
+	timer.Name = newName
+
+	return timer, nil
+}
+
+// DeleteTimer deletes a timer along with its state, history, share tokens and
+// the room that shares it.
+func DeleteTimer(userID UserID, name string) (Timer, error) {
+	if name == DefaultTimerName {
+		return Timer{}, DefaultTimer
+	}
+
+	timer, err := GetTimer(userID, name)
+	if err != nil {
+		return Timer{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return Timer{}, InternalServerError
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		`DELETE FROM state_history WHERE user_id = ? AND timer_id = ?`,
+		`DELETE FROM states WHERE user_id = ? AND timer_id = ?`,
+		`DELETE FROM shares WHERE user_id = ? AND timer_id = ?`,
+		`DELETE FROM webhook_deliveries WHERE user_id = ? AND timer_id = ? AND status = 'pending'`,
+		`DELETE FROM push_notifications WHERE user_id = ? AND timer_id = ?`,
+		`DELETE FROM focus_runs WHERE user_id = ? AND timer_id = ?`,
+		`DELETE FROM timers WHERE user_id = ? AND id = ?`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, userID, timer.ID); err != nil {
+			log.Println(err)
+			return Timer{}, InternalServerError
+		}
+	}
+
+	if err := deleteRooms(tx, `timer_id = ?`, timer.ID); err != nil {
+		log.Println(err)
+		return Timer{}, InternalServerError
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return Timer{}, InternalServerError
+	}
+
+	return timer, nil
+}
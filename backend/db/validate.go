@@ -0,0 +1,210 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+
+	"flowey/hlc"
+	"flowey/timer"
+)
+
+var StateTooLarge = errors.New("state too large")
+
+type UnknownFieldPolicy string
+
+const (
+	// KeepUnknownFields stores fields the server doesn't know as they are, so
+	// that newer clients can add fields before the server learns about them.
+	KeepUnknownFields UnknownFieldPolicy = "keep"
+	// DropUnknownFields silently removes them before storing the state.
+	DropUnknownFields UnknownFieldPolicy = "drop"
+	// RejectUnknownFields refuses states that have any.
+	RejectUnknownFields UnknownFieldPolicy = "reject"
+)
+
+func (policy *UnknownFieldPolicy) String() string {
+	return string(*policy)
+}
+
+func (policy *UnknownFieldPolicy) Set(value string) error {
+	switch UnknownFieldPolicy(value) {
+	case KeepUnknownFields, DropUnknownFields, RejectUnknownFields:
+		*policy = UnknownFieldPolicy(value)
+		return nil
+	default:
+		return fmt.Errorf("expected %q, %q or %q", KeepUnknownFields, DropUnknownFields, RejectUnknownFields)
+	}
+}
+
+// StateLimits are checked against every state a client sends and every state
+// before it is stored.
+type StateLimits struct {
+	MaxSize       int
+	UnknownFields UnknownFieldPolicy
+}
+
+var stateLimits = StateLimits{
+	MaxSize:       16 << 10,
+	UnknownFields: KeepUnknownFields,
+}
+
+func SetStateLimits(limits StateLimits) {
+	stateLimits = limits
+}
+
+// MaxStateSize is the size of the largest state accepted, in bytes.
+func MaxStateSize() int {
+	return stateLimits.MaxSize
+}
+
+const (
+	maxTargetDate     = 8.64e15 // the largest time a JavaScript Date can hold
+	maxEndpointLength = 2048
+	maxUsernameLength = 256
+)
+
+// State is the typed model of the fields the PWA stores. Every field but the
+// version is optional.
+type State struct {
+	Buff        *float64                 `json:"buff"`
+	IsReverseOn *bool                    `json:"isReverseOn"`
+	MaxTime     *int64                   `json:"maxTime"`
+	TargetDate  *float64                 `json:"targetDate"`
+	Endpoint    *string                  `json:"endpoint"`
+	Username    *string                  `json:"username"`
+	Version     int                      `json:"version"`
+	Clocks      map[string]hlc.Timestamp `json:"hlc"`
+}
+
+var knownFields = map[string]bool{
+	"buff":        true,
+	"isReverseOn": true,
+	"maxTime":     true,
+	"targetDate":  true,
+	"endpoint":    true,
+	"username":    true,
+	"version":     true,
+	clocksKey:     true,
+}
+
+func invalidState(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", InvalidState, fmt.Sprintf(format, args...))
+}
+
+func (state State) validate() error {
+	if buff := state.Buff; buff != nil {
+		if *buff < timer.MinBuff || *buff > timer.MaxBuff {
+			return invalidState("buff must be between %.2f and %.2f", timer.MinBuff, timer.MaxBuff)
+		}
+		if steps := *buff * 20; math.Abs(steps-math.Round(steps)) > 1e-6 {
+			return invalidState("buff must be a multiple of 0.05")
+		}
+	}
+
+	if maxTime := state.MaxTime; maxTime != nil {
+		if *maxTime < timer.MinMaxTime || *maxTime > timer.MaxMaxTime {
+			return invalidState("maxTime must be between %d and %d", timer.MinMaxTime, timer.MaxMaxTime)
+		}
+		if *maxTime%(timer.MinMaxTime/24) != 0 {
+			return invalidState("maxTime must be a whole number of hours")
+		}
+	}
+
+	if targetDate := state.TargetDate; targetDate != nil {
+		if math.IsNaN(*targetDate) || math.Abs(*targetDate) > maxTargetDate {
+			return invalidState("targetDate is out of range")
+		}
+	}
+
+	if endpoint := state.Endpoint; endpoint != nil && len(*endpoint) > maxEndpointLength {
+		return invalidState("endpoint must be at most %d bytes long", maxEndpointLength)
+	}
+
+	if username := state.Username; username != nil && len(*username) > maxUsernameLength {
+		return invalidState("username must be at most %d bytes long", maxUsernameLength)
+	}
+
+	if state.Version < 0 || state.Version >= versionModulus {
+		return invalidState("version must be between 0 and %d", versionModulus-1)
+	}
+
+	return nil
+}
+
+// jsonType names a Go type the way a JSON client would know it.
+func jsonType(goType reflect.Type) string {
+	switch goType.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	default:
+		return "an object"
+	}
+}
+
+func checkStateSize(stateString string) error {
+	if len(stateString) > stateLimits.MaxSize {
+		return fmt.Errorf("%w: the limit is %d bytes", StateTooLarge, stateLimits.MaxSize)
+	}
+	return nil
+}
+
+// validateState checks a state against the typed model and the limits, and
+// returns it with unknown fields dropped if the policy says so.
+func validateState(stateString string) (string, error) {
+	if err := checkStateSize(stateString); err != nil {
+		return "", err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(stateString), &fields); err != nil || fields == nil {
+		return "", InvalidState
+	}
+
+	var state State
+	if err := json.Unmarshal([]byte(stateString), &state); err != nil {
+		var typeError *json.UnmarshalTypeError
+		if errors.As(err, &typeError) {
+			return "", invalidState("%s must be %s", typeError.Field, jsonType(typeError.Type))
+		}
+		return "", InvalidState
+	}
+
+	if err := state.validate(); err != nil {
+		return "", err
+	}
+
+	dropped := false
+	for key := range fields {
+		if knownFields[key] {
+			continue
+		}
+
+		switch stateLimits.UnknownFields {
+		case RejectUnknownFields:
+			return "", invalidState("unknown field %q", key)
+		case DropUnknownFields:
+			delete(fields, key)
+			dropped = true
+		}
+	}
+
+	if !dropped {
+		return stateString, nil
+	}
+
+	stateBytes, err := json.Marshal(fields)
+	if err != nil {
+		log.Printf("failed to marshal state: %v", err)
+		return "", InternalServerError
+	}
+
+	return string(stateBytes), nil
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+
+	"flowey/webpush"
+)
+
+func VapidCmd(args []string, path string) error {
+	flagSet := flag.NewFlagSet("flowey db vapid", flag.ExitOnError)
+	subject := flagSet.String("subject", "", "mailto: or https: URL push services can reach the operator at")
+	skipConfirmation := flagSet.Bool("y", false, "skip confirmation")
+
+	flagSet.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage: flowey db vapid [OPTIONS] COMMAND
+  generate    generate a new key, unsubscribing every browser
+  show        print the public key`)
+		fmt.Fprintln(os.Stderr)
+		flagSet.PrintDefaults()
+	}
+
+	flagSet.Parse(args)
+
+	if flagSet.NArg() != 1 || (flagSet.Arg(0) != "generate" && flagSet.Arg(0) != "show") {
+		flagSet.Usage()
+		return nil
+	}
+
+	if flagSet.Arg(0) == "generate" {
+		subjectURL, err := url.Parse(*subject)
+		if err != nil || (subjectURL.Scheme != "mailto" && subjectURL.Scheme != "https") {
+			return fmt.Errorf("the subject must be a mailto: or https: URL")
+		}
+
+		if !*skipConfirmation && !confirmed() {
+			return nil
+		}
+	}
+
+	if err := Prepare(path); err != nil {
+		log.Fatal(err)
+	}
+	defer Close()
+
+	if flagSet.Arg(0) == "generate" {
+		key, err := webpush.GenerateKey()
+		if err != nil {
+			return err
+		}
+		if err := SetVAPID(webpush.VAPID{PrivateKey: key, Subject: *subject}); err != nil {
+			return err
+		}
+		log.Printf("generated a new VAPID key")
+	}
+
+	vapid, err := GetVAPID()
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := webpush.PublicKey(vapid.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("subject: %s\npublic key: %s\n", vapid.Subject, publicKey)
+	return nil
+}
@@ -0,0 +1,632 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"flowey/timer"
+)
+
+var (
+	NoSuchWebhook  = errors.New("no such webhook")
+	InvalidWebhook = errors.New("invalid webhook")
+)
+
+const (
+	maxWebhooks         = 16
+	maxWebhookURLLength = 2048
+
+	// Failed deliveries are retried after 10s, 20s, 40s and so on, up to an
+	// hour apart, and given up after maxDeliveryAttempts.
+	deliveryBackoff     = 10 * time.Second
+	maxDeliveryBackoff  = time.Hour
+	maxDeliveryAttempts = 8
+
+	// maxDeliveryLog is how many finished deliveries are kept per webhook.
+	maxDeliveryLog = 100
+	maxErrorLength = 256
+)
+
+type WebhookID = int64
+
+type WebhookEvent string
+
+const (
+	WebhookStart    WebhookEvent = "start"
+	WebhookStop     WebhookEvent = "stop"
+	WebhookReverse  WebhookEvent = "reverse"
+	WebhookFinished WebhookEvent = "finished"
+	WebhookTest     WebhookEvent = "test"
+)
+
+// webhookEvents are the events a webhook can subscribe to.
+var webhookEvents = []WebhookEvent{WebhookStart, WebhookStop, WebhookReverse, WebhookFinished}
+
+// Webhook receives the timer events of a user as signed JSON posts. The
+// secret is only returned when the webhook is created.
+type Webhook struct {
+	ID        WebhookID      `json:"id"`
+	URL       string         `json:"url"`
+	Events    []WebhookEvent `json:"events"`
+	Secret    string         `json:"secret,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+func (webhook Webhook) subscribes(event WebhookEvent) bool {
+	return slices.Contains(webhook.Events, event)
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// WebhookPayload is the body posted to a webhook. Finished events are queued
+// when the timer starts, so OccurredAt is when the timer is due to finish.
+type WebhookPayload struct {
+	Event      WebhookEvent `json:"event"`
+	Timer      string       `json:"timer,omitempty"`
+	OccurredAt time.Time    `json:"occurredAt"`
+	State      *timer.Timer `json:"state,omitempty"`
+}
+
+// WebhookDelivery is an entry of the delivery log of a webhook.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	Event          WebhookEvent    `json:"event"`
+	Status         DeliveryStatus  `json:"status"`
+	Attempts       int             `json:"attempts"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	NextAttemptAt  *time.Time      `json:"nextAttemptAt,omitempty"`
+	CompletedAt    *time.Time      `json:"completedAt,omitempty"`
+	ResponseStatus *int            `json:"responseStatus,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+// PendingDelivery is a delivery that is due, with what it takes to send it.
+type PendingDelivery struct {
+	ID       int64
+	URL      string
+	Secret   string
+	Event    WebhookEvent
+	Payload  string
+	Attempts int
+}
+
+var deliveriesQueued = make(chan struct{}, 1)
+
+// DeliveriesQueued receives a value when deliveries were queued, so that a
+// sender waiting for the next one can look again.
+func DeliveriesQueued() <-chan struct{} {
+	return deliveriesQueued
+}
+
+func notifyDeliveries() {
+	select {
+	case deliveriesQueued <- struct{}{}:
+	default:
+	}
+}
+
+func parseWebhookEvents(events []WebhookEvent) ([]WebhookEvent, error) {
+	if len(events) == 0 {
+		return slices.Clone(webhookEvents), nil
+	}
+
+	var parsed []WebhookEvent
+	for _, event := range events {
+		if !slices.Contains(webhookEvents, event) {
+			return nil, fmt.Errorf("%w: unknown event %q", InvalidWebhook, event)
+		}
+		if !slices.Contains(parsed, event) {
+			parsed = append(parsed, event)
+		}
+	}
+	return parsed, nil
+}
+
+func validateWebhookURL(rawURL string) error {
+	if len(rawURL) > maxWebhookURLLength {
+		return fmt.Errorf("%w: the url is longer than %d bytes", InvalidWebhook, maxWebhookURLLength)
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%w: the url must be an absolute http or https url", InvalidWebhook)
+	}
+
+	return nil
+}
+
+func scanWebhook(scanner interface{ Scan(...any) error }) (Webhook, error) {
+	var webhook Webhook
+	var events string
+	var createdAt int64
+
+	if err := scanner.Scan(&webhook.ID, &webhook.URL, &events, &createdAt); err != nil {
+		return Webhook{}, err
+	}
+
+	for _, event := range strings.Split(events, ",") {
+		webhook.Events = append(webhook.Events, WebhookEvent(event))
+	}
+	webhook.CreatedAt = time.UnixMilli(createdAt).UTC()
+
+	return webhook, nil
+}
+
+func queryWebhooks(queryer interface {
+	Query(string, ...any) (*sql.Rows, error)
+}, userID UserID) ([]Webhook, error) {
+	query := `SELECT id, url, events, created_at FROM webhooks WHERE user_id = ? ORDER BY id`
+	rows, err := queryer.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+func ListWebhooks(userID UserID) ([]Webhook, error) {
+	webhooks, err := queryWebhooks(db, userID)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	return webhooks, nil
+}
+
+func GetWebhook(userID UserID, id WebhookID) (Webhook, error) {
+	query := `SELECT id, url, events, created_at FROM webhooks WHERE user_id = ? AND id = ?`
+	webhook, err := scanWebhook(db.QueryRow(query, userID, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Webhook{}, NoSuchWebhook
+		}
+		log.Println(err)
+		return Webhook{}, InternalServerError
+	}
+	return webhook, nil
+}
+
+// CreateWebhook registers a webhook for the given events, or for all of them
+// if there are none.
+func CreateWebhook(userID UserID, rawURL string, events []WebhookEvent) (Webhook, error) {
+	if err := validateWebhookURL(rawURL); err != nil {
+		return Webhook{}, err
+	}
+
+	events, err := parseWebhookEvents(events)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM webhooks WHERE user_id = ?`, userID).Scan(&count); err != nil {
+		log.Println(err)
+		return Webhook{}, InternalServerError
+	}
+	if count >= maxWebhooks {
+		return Webhook{}, fmt.Errorf("%w: a user can have at most %d webhooks", InvalidWebhook, maxWebhooks)
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		log.Println(err)
+		return Webhook{}, InternalServerError
+	}
+
+	webhook := Webhook{
+		URL:       rawURL,
+		Events:    events,
+		Secret:    secret,
+		CreatedAt: time.UnixMilli(time.Now().UnixMilli()).UTC(),
+	}
+
+	eventNames := make([]string, len(events))
+	for index, event := range events {
+		eventNames[index] = string(event)
+	}
+
+	query := `INSERT INTO webhooks (user_id, url, secret, events, created_at) VALUES (?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, userID, rawURL, secret, strings.Join(eventNames, ","), webhook.CreatedAt.UnixMilli())
+	if err != nil {
+		log.Println(err)
+		return Webhook{}, InternalServerError
+	}
+
+	webhook.ID, err = result.LastInsertId()
+	if err != nil {
+		log.Println(err)
+		return Webhook{}, InternalServerError
+	}
+
+	return webhook, nil
+}
+
+// DeleteWebhook deletes a webhook with its pending deliveries and log.
+func DeleteWebhook(userID UserID, id WebhookID) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM webhooks WHERE user_id = ? AND id = ?`, userID, id)
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+	if deleted == 0 {
+		return NoSuchWebhook
+	}
+
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+
+	return nil
+}
+
+func scanDelivery(scanner interface{ Scan(...any) error }) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var payload string
+	var createdAt, nextAttemptAt int64
+	var completedAt, responseStatus sql.NullInt64
+
+	if err := scanner.Scan(
+		&delivery.ID, &delivery.Event, &delivery.Status, &delivery.Attempts, &createdAt,
+		&nextAttemptAt, &completedAt, &responseStatus, &delivery.Error, &payload,
+	); err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	delivery.Payload = json.RawMessage(payload)
+	delivery.CreatedAt = time.UnixMilli(createdAt).UTC()
+	if delivery.Status == DeliveryPending {
+		at := time.UnixMilli(nextAttemptAt).UTC()
+		delivery.NextAttemptAt = &at
+	}
+	if completedAt.Valid {
+		at := time.UnixMilli(completedAt.Int64).UTC()
+		delivery.CompletedAt = &at
+	}
+	if responseStatus.Valid {
+		status := int(responseStatus.Int64)
+		delivery.ResponseStatus = &status
+	}
+
+	return delivery, nil
+}
+
+const deliveryQuery = `SELECT id, event, status, attempts, created_at, next_attempt_at, completed_at, response_status, error, payload
+FROM webhook_deliveries`
+
+// ListWebhookDeliveries returns the pending and recent deliveries of a
+// webhook, newest first.
+func ListWebhookDeliveries(userID UserID, id WebhookID) ([]WebhookDelivery, error) {
+	if _, err := GetWebhook(userID, id); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(deliveryQuery+` WHERE webhook_id = ? ORDER BY id DESC`, id)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return deliveries, nil
+}
+
+func queueDelivery(tx *sql.Tx, userID UserID, webhookID WebhookID, timerID *TimerID, payload WebhookPayload, at time.Time) (int64, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO webhook_deliveries (webhook_id, user_id, timer_id, event, payload, status, attempts, created_at, next_attempt_at, error)
+VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, '')`
+	result, err := tx.Exec(
+		query, webhookID, userID, timerID, payload.Event, string(payloadBytes),
+		DeliveryPending, time.Now().UnixMilli(), at.UnixMilli(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// TestWebhook queues a test event for a webhook, whatever events it
+// subscribes to.
+func TestWebhook(userID UserID, id WebhookID) (WebhookDelivery, error) {
+	if _, err := GetWebhook(userID, id); err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return WebhookDelivery{}, InternalServerError
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	payload := WebhookPayload{Event: WebhookTest, OccurredAt: time.UnixMilli(now.UnixMilli()).UTC()}
+	deliveryID, err := queueDelivery(tx, userID, id, nil, payload, now)
+	if err != nil {
+		log.Println(err)
+		return WebhookDelivery{}, InternalServerError
+	}
+
+	delivery, err := scanDelivery(tx.QueryRow(deliveryQuery+` WHERE id = ?`, deliveryID))
+	if err != nil {
+		log.Println(err)
+		return WebhookDelivery{}, InternalServerError
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return WebhookDelivery{}, InternalServerError
+	}
+	notifyDeliveries()
+
+	return delivery, nil
+}
+
+// parseTimer reads the timer out of a stored state. States that aren't a
+// valid timer, such as a missing state, count as not running.
+func parseTimer(stateString string) (timer.Timer, bool) {
+	var parsed timer.Timer
+	if stateString == "" || json.Unmarshal([]byte(stateString), &parsed) != nil || parsed.Buff < timer.MinBuff {
+		return timer.Timer{}, false
+	}
+	return parsed, true
+}
+
+// timerEvents derives the events of a write that changed the timer from
+// previous to next at now.
+func timerEvents(previous timer.Timer, wasTimer bool, next timer.Timer, now int64) []WebhookEvent {
+	wasOn := wasTimer && previous.IsOn(now)
+	isOn := next.IsOn(now)
+
+	switch {
+	case !wasOn && isOn:
+		return []WebhookEvent{WebhookStart}
+	case wasOn && !isOn:
+		return []WebhookEvent{WebhookStop}
+	case wasOn && isOn && previous.IsReverseOn != next.IsReverseOn:
+		return []WebhookEvent{WebhookReverse}
+	}
+	return nil
+}
+
+// queueTimerEvents queues the events of a state write for the webhooks of the
+// user, in the transaction of the write. The finished event is queued for
+// when the running timer is due to finish, replacing one queued by an earlier
+// write. It reports whether it queued anything.
+func queueTimerEvents(tx *sql.Tx, key StateKey, previousStateString string, stateString string) (bool, error) {
+	webhooks, err := queryWebhooks(tx, key.UserID)
+	if err != nil || len(webhooks) == 0 {
+		return false, err
+	}
+
+	now := time.Now()
+	query := `DELETE FROM webhook_deliveries
+WHERE user_id = ? AND timer_id = ? AND event = ? AND status = ? AND attempts = 0 AND next_attempt_at > ?`
+	if _, err := tx.Exec(query, key.UserID, key.TimerID, WebhookFinished, DeliveryPending, now.UnixMilli()); err != nil {
+		return false, err
+	}
+
+	next, isTimer := parseTimer(stateString)
+	if !isTimer {
+		return false, nil
+	}
+	previous, wasTimer := parseTimer(previousStateString)
+
+	var timerName string
+	if err := tx.QueryRow(`SELECT name FROM timers WHERE id = ?`, key.TimerID).Scan(&timerName); err != nil {
+		return false, err
+	}
+
+	occurredAt := time.UnixMilli(now.UnixMilli()).UTC()
+	queued := false
+	for _, event := range timerEvents(previous, wasTimer, next, now.UnixMilli()) {
+		payload := WebhookPayload{Event: event, Timer: timerName, OccurredAt: occurredAt, State: &next}
+		for _, webhook := range webhooks {
+			if !webhook.subscribes(event) {
+				continue
+			}
+			if _, err := queueDelivery(tx, key.UserID, webhook.ID, &key.TimerID, payload, now); err != nil {
+				return false, err
+			}
+			queued = true
+		}
+	}
+
+	if finishesAt := int64(next.FinishesAt()); next.IsOn(now.UnixMilli()) && finishesAt > now.UnixMilli() {
+		at := time.UnixMilli(finishesAt).UTC()
+		payload := WebhookPayload{Event: WebhookFinished, Timer: timerName, OccurredAt: at, State: &next}
+		for _, webhook := range webhooks {
+			if !webhook.subscribes(WebhookFinished) {
+				continue
+			}
+			if _, err := queueDelivery(tx, key.UserID, webhook.ID, &key.TimerID, payload, at); err != nil {
+				return false, err
+			}
+			queued = true
+		}
+	}
+
+	return queued, nil
+}
+
+// DueDeliveries returns up to limit pending deliveries whose next attempt is
+// due at now, oldest first.
+func DueDeliveries(now time.Time, limit int) ([]PendingDelivery, error) {
+	query := `SELECT webhook_deliveries.id, webhooks.url, webhooks.secret, webhook_deliveries.event,
+  webhook_deliveries.payload, webhook_deliveries.attempts
+FROM webhook_deliveries JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+WHERE webhook_deliveries.status = ? AND webhook_deliveries.next_attempt_at <= ?
+ORDER BY webhook_deliveries.next_attempt_at, webhook_deliveries.id LIMIT ?`
+	rows, err := db.Query(query, DeliveryPending, now.UnixMilli(), limit)
+	if err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+
+	var deliveries []PendingDelivery
+	for rows.Next() {
+		var delivery PendingDelivery
+		if err := rows.Scan(
+			&delivery.ID, &delivery.URL, &delivery.Secret, &delivery.Event,
+			&delivery.Payload, &delivery.Attempts,
+		); err != nil {
+			log.Println(err)
+			return nil, InternalServerError
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, InternalServerError
+	}
+
+	return deliveries, nil
+}
+
+// NextDeliveryAt returns when the earliest pending delivery is due.
+func NextDeliveryAt() (at time.Time, ok bool, err error) {
+	var nextAttemptAt sql.NullInt64
+	query := `SELECT MIN(next_attempt_at) FROM webhook_deliveries WHERE status = ?`
+	if err := db.QueryRow(query, DeliveryPending).Scan(&nextAttemptAt); err != nil {
+		log.Println(err)
+		return time.Time{}, false, InternalServerError
+	}
+	if !nextAttemptAt.Valid {
+		return time.Time{}, false, nil
+	}
+	return time.UnixMilli(nextAttemptAt.Int64), true, nil
+}
+
+func backoff(attempts int) time.Duration {
+	delay := deliveryBackoff
+	for range attempts - 1 {
+		delay *= 2
+		if delay >= maxDeliveryBackoff {
+			return maxDeliveryBackoff
+		}
+	}
+	return delay
+}
+
+// RecordDeliveryAttempt records the outcome of sending a delivery at the given
+// time: the response status, if there was a response, and why it failed, if it
+// did. A failed delivery is retried with exponential backoff until it runs out
+// of attempts.
+func RecordDeliveryAttempt(delivery PendingDelivery, at time.Time, responseStatus int, deliveryErr error) error {
+	attempts := delivery.Attempts + 1
+	status := DeliveryDelivered
+	errorText := ""
+	completedAt := sql.NullInt64{Int64: at.UnixMilli(), Valid: true}
+	nextAttemptAt := at
+
+	if deliveryErr != nil {
+		errorText = truncate(deliveryErr.Error(), maxErrorLength)
+		status = DeliveryFailed
+		if attempts < maxDeliveryAttempts {
+			status = DeliveryPending
+			completedAt = sql.NullInt64{}
+			nextAttemptAt = at.Add(backoff(attempts))
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+	defer tx.Rollback()
+
+	var webhookID WebhookID
+	query := `UPDATE webhook_deliveries
+SET status = ?, attempts = ?, next_attempt_at = ?, completed_at = ?, response_status = ?, error = ?
+WHERE id = ? RETURNING webhook_id`
+	err = tx.QueryRow(
+		query, status, attempts, nextAttemptAt.UnixMilli(), completedAt,
+		sql.NullInt64{Int64: int64(responseStatus), Valid: responseStatus != 0}, errorText, delivery.ID,
+	).Scan(&webhookID)
+	if err == sql.ErrNoRows {
+		// The webhook was deleted while the delivery was being sent.
+		return nil
+	}
+	if err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+
+	query = `DELETE FROM webhook_deliveries WHERE webhook_id = ? AND status != ? AND id NOT IN (
+  SELECT id FROM webhook_deliveries WHERE webhook_id = ? AND status != ? ORDER BY id DESC LIMIT ?
+)`
+	if _, err := tx.Exec(query, webhookID, DeliveryPending, webhookID, DeliveryPending, maxDeliveryLog); err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return InternalServerError
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+// Package hlc implements hybrid logical clocks: timestamps that follow wall
+// time but still order events correctly when clocks drift apart.
+package hlc
+
+import (
+	"cmp"
+	"sync"
+	"time"
+)
+
+// Timestamp is a point in hybrid logical time. Wall is in milliseconds since
+// the Unix epoch, Logical orders events within the same millisecond and Node
+// breaks the remaining ties.
+type Timestamp struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical"`
+	Node    string `json:"node"`
+}
+
+func (timestamp Timestamp) IsZero() bool {
+	return timestamp == Timestamp{}
+}
+
+// Compare returns -1, 0 or +1 depending on whether a is before, equal to or
+// after b.
+func Compare(a, b Timestamp) int {
+	if c := cmp.Compare(a.Wall, b.Wall); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.Logical, b.Logical); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Node, b.Node)
+}
+
+type Clock struct {
+	node  string
+	now   func() time.Time
+	last  Timestamp
+	mutex sync.Mutex
+}
+
+func NewClock(node string, now func() time.Time) *Clock {
+	if now == nil {
+		now = time.Now
+	}
+	return &Clock{node: node, now: now}
+}
+
+// Now returns a timestamp later than every timestamp the clock has issued.
+func (clock *Clock) Now() Timestamp {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	wall := clock.now().UnixMilli()
+	if wall > clock.last.Wall {
+		clock.last = Timestamp{Wall: wall, Node: clock.node}
+	} else {
+		clock.last = Timestamp{Wall: clock.last.Wall, Logical: clock.last.Logical + 1, Node: clock.node}
+	}
+
+	return clock.last
+}
@@ -0,0 +1,212 @@
+// Package jobs runs the persistent jobs of the database: work of a named kind
+// that is due at a later time, survives restarts and is retried with backoff
+// when it fails.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"flowey/db"
+)
+
+const (
+	// DefaultLease is how long a runner may work on a job before another
+	// runner may take it over. Handlers are canceled when it runs out.
+	DefaultLease = time.Minute
+
+	idleInterval = time.Minute
+
+	backoffBase = 30 * time.Second
+	maxBackoff  = time.Hour
+)
+
+// Clock tells the runner the time and lets it wait, so that tests can drive
+// it.
+type Clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+// SystemClock is the real clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) After(duration time.Duration) <-chan time.Time {
+	return time.After(duration)
+}
+
+// Handler does the work of a job. A job whose handler fails is retried,
+// unless the error is Permanent.
+type Handler func(ctx context.Context, job db.Job) error
+
+type permanentError struct {
+	err error
+}
+
+func (err permanentError) Error() string {
+	return err.err.Error()
+}
+
+func (err permanentError) Unwrap() error {
+	return err.err
+}
+
+// Permanent marks an error a retry can't fix.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Backoff is how long a job waits after its nth failed attempt: 30 seconds,
+// doubling up to an hour.
+func Backoff(attempts int) time.Duration {
+	delay := backoffBase
+	for range attempts - 1 {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
+
+// Runner claims the due jobs of the kinds it handles and runs them one at a
+// time.
+type Runner struct {
+	clock    Clock
+	owner    string
+	lease    time.Duration
+	mutex    sync.Mutex
+	handlers map[string]Handler
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func NewRunner(clock Clock) *Runner {
+	if clock == nil {
+		clock = SystemClock{}
+	}
+
+	owner := make([]byte, 8)
+	rand.Read(owner)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		clock:    clock,
+		owner:    hex.EncodeToString(owner),
+		lease:    DefaultLease,
+		handlers: make(map[string]Handler),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+}
+
+// Handle registers the handler of a job kind.
+func (runner *Runner) Handle(kind string, handler Handler) {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+
+	runner.handlers[kind] = handler
+}
+
+func (runner *Runner) kinds() []string {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+
+	kinds := make([]string, 0, len(runner.handlers))
+	for kind := range runner.handlers {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+	return kinds
+}
+
+func (runner *Runner) handler(kind string) Handler {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+
+	return runner.handlers[kind]
+}
+
+// Start runs jobs in the background until Close.
+func (runner *Runner) Start() {
+	go runner.run()
+}
+
+func (runner *Runner) run() {
+	defer close(runner.done)
+
+	for {
+		runner.RunDue()
+
+		wait := idleInterval
+		if at, ok, err := db.NextJobAt(runner.kinds()); err == nil && ok {
+			wait = min(max(at.Sub(runner.clock.Now()), 0), idleInterval)
+		}
+
+		select {
+		case <-runner.ctx.Done():
+			return
+		case <-db.JobsQueued():
+		case <-runner.clock.After(wait):
+		}
+	}
+}
+
+// RunDue runs the jobs that are due now and returns how many it ran. Jobs
+// are claimed one at a time, right before they run, so that the lease of a
+// job doesn't run out while the runner is busy with others.
+func (runner *Runner) RunDue() int {
+	ran := 0
+	for runner.ctx.Err() == nil {
+		jobs, err := db.ClaimJobs(runner.owner, runner.kinds(), runner.clock.Now(), runner.lease, 1)
+		if err != nil || len(jobs) == 0 {
+			return ran
+		}
+
+		runner.runJob(jobs[0])
+		ran++
+	}
+	return ran
+}
+
+func (runner *Runner) runJob(job db.Job) {
+	// The handler is canceled when the lease runs out.
+	ctx, cancel := context.WithTimeout(runner.ctx, job.LeaseUntil.Sub(runner.clock.Now()))
+	defer cancel()
+
+	err := runner.handler(job.Kind)(ctx, job)
+	if runner.ctx.Err() != nil {
+		// Shutting down; the job is taken over when its lease expires.
+		return
+	}
+
+	now := runner.clock.Now()
+	if err == nil {
+		err = db.CompleteJob(job, now)
+	} else {
+		log.Printf("job %d (%s) failed: %v", job.ID, job.Kind, err)
+		var permanent permanentError
+		err = db.FailJob(job, now, err, Backoff(job.Attempts), errors.As(err, &permanent))
+	}
+	if errors.Is(err, db.LostLease) {
+		log.Printf("job %d (%s) outlived its lease", job.ID, job.Kind)
+	}
+}
+
+// Close stops the runner, waiting for the running job's handler to return.
+func (runner *Runner) Close() {
+	runner.cancel()
+	<-runner.done
+}
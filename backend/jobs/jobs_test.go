@@ -0,0 +1,159 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"flowey/db"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// fakeClock only moves when a test sets it.
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *fakeClock) After(time.Duration) <-chan time.Time {
+	return nil
+}
+
+func prepareDB(t *testing.T) {
+	t.Helper()
+	if err := db.Prepare(filepath.Join(t.TempDir(), "flowey.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+}
+
+func onlyJob(t *testing.T) db.Job {
+	t.Helper()
+	jobs, err := db.ListJobs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(jobs))
+	}
+	return jobs[0]
+}
+
+func TestRetryAndLeaseExpiry(t *testing.T) {
+	prepareDB(t)
+
+	start := time.UnixMilli(1792411200000).UTC()
+	clock := &fakeClock{now: start}
+	runner := NewRunner(clock)
+
+	var handlerErr error
+	runs := 0
+	runner.Handle("test", func(ctx context.Context, job db.Job) error {
+		runs++
+		if want := clock.now.Add(DefaultLease); !job.LeaseUntil.Equal(want) {
+			t.Errorf("got a lease until %v, want %v", job.LeaseUntil, want)
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("the handler has no deadline")
+		}
+		return handlerErr
+	})
+
+	if _, err := db.EnqueueJob(db.NewJob{Kind: "test", RunAt: start, MaxAttempts: 3}, start); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first attempt fails and the job waits out the backoff.
+	handlerErr = errors.New("boom")
+	if ran := runner.RunDue(); ran != 1 {
+		t.Fatalf("ran %d jobs, want 1", ran)
+	}
+	job := onlyJob(t)
+	if job.Status != db.JobPending || job.Attempts != 1 || job.LastError != "boom" {
+		t.Fatalf("got %+v after a failed attempt", job)
+	}
+	if want := start.Add(Backoff(1)); !job.RunAt.Equal(want) {
+		t.Fatalf("got a retry at %v, want %v", job.RunAt, want)
+	}
+
+	clock.now = start.Add(Backoff(1) - time.Millisecond)
+	if ran := runner.RunDue(); ran != 0 {
+		t.Fatalf("ran %d jobs before the backoff ran out, want 0", ran)
+	}
+
+	// Another runner claims the retry and never finishes it.
+	clock.now = start.Add(Backoff(1))
+	claimed, err := db.ClaimJobs("other", []string{"test"}, clock.now, DefaultLease, 1)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("got %v, %v from claiming the retry", claimed, err)
+	}
+	if ran := runner.RunDue(); ran != 0 {
+		t.Fatalf("ran %d jobs leased to another runner, want 0", ran)
+	}
+
+	// Once the lease expires, the runner takes the job over.
+	handlerErr = nil
+	clock.now = claimed[0].LeaseUntil.Add(-time.Millisecond)
+	if ran := runner.RunDue(); ran != 0 {
+		t.Fatalf("ran %d jobs before the lease expired, want 0", ran)
+	}
+	clock.now = *claimed[0].LeaseUntil
+	if ran := runner.RunDue(); ran != 1 {
+		t.Fatalf("ran %d jobs after the lease expired, want 1", ran)
+	}
+	job = onlyJob(t)
+	if job.Status != db.JobDone || job.Attempts != 3 {
+		t.Fatalf("got %+v after taking the job over", job)
+	}
+	if runs != 2 {
+		t.Fatalf("the handler ran %d times, want 2", runs)
+	}
+
+	if err := db.CompleteJob(claimed[0], clock.now); !errors.Is(err, db.LostLease) {
+		t.Fatalf("got %v completing a job whose lease expired, want %v", err, db.LostLease)
+	}
+}
+
+func TestClaimOneAtATime(t *testing.T) {
+	prepareDB(t)
+
+	start := time.UnixMilli(1792411200000).UTC()
+	clock := &fakeClock{now: start}
+	runner := NewRunner(clock)
+
+	runner.Handle("test", func(ctx context.Context, job db.Job) error {
+		running, err := db.ListJobs(db.JobRunning)
+		if err != nil {
+			return err
+		}
+		if len(running) != 1 {
+			t.Errorf("%d jobs are leased while one runs, want 1", len(running))
+		}
+		// Each job takes most of a lease.
+		clock.now = clock.now.Add(DefaultLease - time.Second)
+		return nil
+	})
+
+	for range 3 {
+		if _, err := db.EnqueueJob(db.NewJob{Kind: "test", RunAt: start}, start); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ran := runner.RunDue(); ran != 3 {
+		t.Fatalf("ran %d jobs, want 3", ran)
+	}
+	done, err := db.ListJobs(db.JobDone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 3 {
+		t.Fatalf("%d jobs are done, want 3", len(done))
+	}
+}
@@ -0,0 +1,340 @@
+// Package jsonpatch applies RFC 6902 JSON Patch documents to JSON values.
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	InvalidPatch = errors.New("invalid patch")
+	PathNotFound = errors.New("path not found")
+	TestFailed   = errors.New("test failed")
+)
+
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type Patch []Operation
+
+func decode(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func Parse(data []byte) (Patch, error) {
+	var patch Patch
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidPatch, err)
+	}
+
+	for _, operation := range patch {
+		switch operation.Op {
+		case "add", "replace", "test":
+			if operation.Value == nil {
+				return nil, fmt.Errorf("%w: %q operation without a value", InvalidPatch, operation.Op)
+			}
+		case "remove":
+		case "move", "copy":
+			if _, err := parsePointer(operation.From); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown operation %q", InvalidPatch, operation.Op)
+		}
+
+		if _, err := parsePointer(operation.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	return patch, nil
+}
+
+// Apply applies the patch to the document and returns the result. Operations
+// are applied in order and the document is left untouched if any of them
+// fails.
+func Apply(document []byte, patch Patch) ([]byte, error) {
+	value, err := decode(document)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid document: %v", InvalidPatch, err)
+	}
+
+	for index, operation := range patch {
+		value, err = apply(value, operation)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", index, err)
+		}
+	}
+
+	return json.Marshal(value)
+}
+
+func apply(document any, operation Operation) (any, error) {
+	path, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch operation.Op {
+	case "add":
+		value, err := decode(operation.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid value: %v", InvalidPatch, err)
+		}
+		return add(document, path, value)
+	case "remove":
+		document, _, err := remove(document, path)
+		return document, err
+	case "replace":
+		value, err := decode(operation.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid value: %v", InvalidPatch, err)
+		}
+		return replace(document, path, value)
+	case "move":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		if len(from) < len(path) && isPrefix(from, path) {
+			return nil, fmt.Errorf("%w: can't move %q into itself", InvalidPatch, operation.From)
+		}
+		document, value, err := remove(document, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(document, path, value)
+	case "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := get(document, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(document, path, deepCopy(value))
+	case "test":
+		expected, err := decode(operation.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid value: %v", InvalidPatch, err)
+		}
+		actual, err := get(document, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(actual, expected) {
+			return nil, fmt.Errorf("%w: %q", TestFailed, operation.Path)
+		}
+		return document, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown operation %q", InvalidPatch, operation.Op)
+	}
+}
+
+func child(node any, token string) (any, error) {
+	switch container := node.(type) {
+	case map[string]any:
+		value, ok := container[token]
+		if !ok {
+			return nil, fmt.Errorf("%w: no member %q", PathNotFound, token)
+		}
+		return value, nil
+	case []any:
+		index, err := arrayIndex(token, len(container), false)
+		if err != nil {
+			return nil, err
+		}
+		return container[index], nil
+	default:
+		return nil, fmt.Errorf("%w: %q is inside a scalar", PathNotFound, token)
+	}
+}
+
+func get(document any, path []string) (any, error) {
+	node := document
+	for _, token := range path {
+		var err error
+		if node, err = child(node, token); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// update replaces the parent of the location named by path with the result of
+// change and returns the new document.
+func update(node any, path []string, change func(parent any, token string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return change(node, path[0])
+	}
+
+	next, err := child(node, path[0])
+	if err != nil {
+		return nil, err
+	}
+
+	next, err = update(next, path[1:], change)
+	if err != nil {
+		return nil, err
+	}
+
+	switch container := node.(type) {
+	case map[string]any:
+		container[path[0]] = next
+	case []any:
+		index, _ := arrayIndex(path[0], len(container), false)
+		container[index] = next
+	}
+	return node, nil
+}
+
+func add(document any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(document, path, func(parent any, token string) (any, error) {
+		switch container := parent.(type) {
+		case map[string]any:
+			container[token] = value
+			return container, nil
+		case []any:
+			index, err := arrayIndex(token, len(container), true)
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		default:
+			return nil, fmt.Errorf("%w: %q is inside a scalar", PathNotFound, token)
+		}
+	})
+}
+
+func remove(document any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w: can't remove the whole document", InvalidPatch)
+	}
+
+	var removed any
+	document, err := update(document, path, func(parent any, token string) (any, error) {
+		switch container := parent.(type) {
+		case map[string]any:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: no member %q", PathNotFound, token)
+			}
+			removed = value
+			delete(container, token)
+			return container, nil
+		case []any:
+			index, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = container[index]
+			return append(container[:index], container[index+1:]...), nil
+		default:
+			return nil, fmt.Errorf("%w: %q is inside a scalar", PathNotFound, token)
+		}
+	})
+	return document, removed, err
+}
+
+func replace(document any, path []string, value any) (any, error) {
+	if _, err := get(document, path); err != nil {
+		return nil, err
+	}
+
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(document, path, func(parent any, token string) (any, error) {
+		switch container := parent.(type) {
+		case map[string]any:
+			container[token] = value
+		case []any:
+			index, _ := arrayIndex(token, len(container), false)
+			container[index] = value
+		}
+		return parent, nil
+	})
+}
+
+func deepCopy(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		copied := make(map[string]any, len(value))
+		for key, member := range value {
+			copied[key] = deepCopy(member)
+		}
+		return copied
+	case []any:
+		copied := make([]any, len(value))
+		for index, element := range value {
+			copied[index] = deepCopy(element)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+// equal compares two decoded JSON values, treating numbers as equal when
+// they have the same value regardless of how they are written.
+func equal(a any, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, member := range a {
+			other, ok := b[key]
+			if !ok || !equal(member, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for index := range a {
+			if !equal(a[index], b[index]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, okA := new(big.Float).SetString(a.String())
+		y, okB := new(big.Float).SetString(b.String())
+		return okA && okB && x.Cmp(y) == 0
+	default:
+		return a == b
+	}
+}
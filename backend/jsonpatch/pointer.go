@@ -0,0 +1,65 @@
+package jsonpatch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped reference
+// tokens. The empty pointer refers to the whole document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: pointer %q doesn't start with a slash", InvalidPatch, pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for index, token := range tokens {
+		token = strings.ReplaceAll(token, "~1", "/")
+		token = strings.ReplaceAll(token, "~0", "~")
+		tokens[index] = token
+	}
+
+	return tokens, nil
+}
+
+// arrayIndex parses a reference token as an index into an array of the given
+// length. The index may be equal to the length only if end is allowed.
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if end && token == "-" {
+		return length, nil
+	}
+
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%w: invalid array index %q", PathNotFound, token)
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("%w: invalid array index %q", PathNotFound, token)
+	}
+
+	if index > length || (index == length && !end) {
+		return 0, fmt.Errorf("%w: array index %d out of range", PathNotFound, index)
+	}
+
+	return index, nil
+}
+
+func isPrefix(prefix []string, tokens []string) bool {
+	if len(prefix) > len(tokens) {
+		return false
+	}
+
+	for index := range prefix {
+		if prefix[index] != tokens[index] {
+			return false
+		}
+	}
+
+	return true
+}
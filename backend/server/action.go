@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"flowey/db"
+	"flowey/timer"
+)
+
+type actionHandler struct {
+	config Config
+	hubs   *hubs
+}
+
+func (handler *actionHandler) handlePost(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	subscription, ok := requestSubscription(writer, request, userID)
+	if !ok {
+		return
+	}
+
+	body, ok := readBody(writer, request)
+	if !ok {
+		return
+	}
+
+	var payload actionPayload
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		http.Error(writer, "couldn't parse the body as a JSON object", http.StatusBadRequest)
+		return
+	}
+
+	payload.At, err = checkActionTime(payload.At, 0, handler.config.MaxClockError)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, update, err := handler.hubs.submit(subscription.key, applyAction(subscription, requestOrigin("http", request), payload))
+	if err != nil {
+		switch {
+		case errors.Is(err, db.Forbidden):
+			http.Error(writer, err.Error(), http.StatusForbidden)
+		case errors.Is(err, db.NoSuchRoom):
+			http.Error(writer, err.Error(), http.StatusNotFound)
+		case errors.Is(err, timer.UnknownAction):
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, timer.InvalidTransition), errors.Is(err, db.InvalidState):
+			http.Error(writer, err.Error(), http.StatusConflict)
+		default:
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	writeState(writer, http.StatusOK, update.stateString, update.revision)
+}
+
+func (handler *actionHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	writer.Header().Set("Access-Control-Expose-Headers", "ETag")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *actionHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodPost:
+		handler.handlePost(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"flowey/db"
+)
+
+func bearerToken(request *http.Request) (string, bool) {
+	authHeader := request.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", false
+	}
+
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+const sessionCookieName = "flowey_session"
+
+func cookieToken(request *http.Request) (string, bool) {
+	cookie, err := request.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+
+	return cookie.Value, true
+}
+
+func setSessionCookie(writer http.ResponseWriter, sessionToken string) {
+	http.SetCookie(writer, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionToken,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(writer http.ResponseWriter) {
+	http.SetCookie(writer, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func authenticate(writer http.ResponseWriter, request *http.Request) (db.UserID, bool) {
+	sessionToken, ok := bearerToken(request)
+	if !ok {
+		writer.WriteHeader(http.StatusUnauthorized)
+		return -1, false
+	}
+
+	return authenticateToken(writer, sessionToken)
+}
+
+// requestToken returns the session token of a request, from the Authorization
+// header or else from the session cookie.
+func requestToken(request *http.Request) (string, bool) {
+	sessionToken, ok := bearerToken(request)
+	if !ok {
+		sessionToken, ok = cookieToken(request)
+	}
+	return sessionToken, ok
+}
+
+func authenticateWithCookie(writer http.ResponseWriter, request *http.Request) (db.UserID, bool) {
+	sessionToken, ok := requestToken(request)
+	if !ok {
+		writer.WriteHeader(http.StatusUnauthorized)
+		return -1, false
+	}
+
+	return authenticateToken(writer, sessionToken)
+}
+
+func authenticateToken(writer http.ResponseWriter, sessionToken string) (db.UserID, bool) {
+	userID, err := db.AuthenticateBySessionToken(sessionToken)
+	if err != nil {
+		switch err {
+		case db.Unathorized:
+			writer.WriteHeader(http.StatusUnauthorized)
+		default:
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+		return -1, false
+	}
+
+	return userID, true
+}
+
+// credentialedOrigins are the origins whose scripts may send the session
+// cookie along and read the answers. Set it before serving.
+var credentialedOrigins = map[string]bool{}
+
+func setCredentialedOrigins(origins []string) {
+	credentialedOrigins = make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		credentialedOrigins[origin] = true
+	}
+}
+
+// allowOrigin lets scripts of any origin call the API with a bearer token, but
+// only those of credentialedOrigins with the session cookie.
+func allowOrigin(writer http.ResponseWriter, request *http.Request) {
+	origin := request.Header.Get("Origin")
+	switch {
+	case origin == "":
+	case credentialedOrigins[origin]:
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+		writer.Header().Set("Access-Control-Allow-Credentials", "true")
+	default:
+		writer.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	writer.Header().Set("Vary", "Origin")
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"flowey/db"
+)
+
+func writeCalendarError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.NoSuchCalendarFeed), errors.Is(err, db.NoSuchTimer):
+		http.Error(writer, err.Error(), http.StatusNotFound)
+	case errors.Is(err, db.InvalidCalendarFeed), errors.Is(err, db.InvalidRange):
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// calendarsHandler lists and mints the calendar feed tokens of the
+// authenticated user.
+type calendarsHandler struct{}
+
+func (handler *calendarsHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	feeds, err := db.ListCalendarFeeds(userID)
+	if err != nil {
+		writeCalendarError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, feeds)
+}
+
+func (handler *calendarsHandler) handlePost(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Label string `json:"label"`
+	}
+	if !readJSON(writer, request, &payload) {
+		return
+	}
+
+	feed, err := db.CreateCalendarFeed(userID, payload.Label)
+	if err != nil {
+		writeCalendarError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusCreated, feed)
+}
+
+func (handler *calendarsHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *calendarsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodPost:
+		handler.handlePost(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// calendarHandler revokes a calendar feed token.
+type calendarHandler struct{}
+
+func (handler *calendarHandler) handleDelete(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	feedID, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(writer, "couldn't parse the calendar feed id", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.RevokeCalendarFeed(userID, feedID); err != nil {
+		writeCalendarError(writer, err)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *calendarHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *calendarHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodDelete:
+		handler.handleDelete(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// calendarFeedHandler serves the completed focus runs of a user as an
+// iCalendar feed to anyone holding a feed token. Calendar apps can't send an
+// Authorization header, so the token in the path is the only credential.
+type calendarFeedHandler struct{}
+
+func (handler *calendarFeedHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	feed, err := db.CalendarFeedByToken(strings.TrimSuffix(request.PathValue("token"), ".ics"))
+	if err != nil {
+		writeCalendarError(writer, err)
+		return
+	}
+
+	now := time.Now()
+	runs, err := db.CalendarFeedRuns(feed, now)
+	if err != nil {
+		writeCalendarError(writer, err)
+		return
+	}
+
+	name := "Flowey"
+	if feed.Label != "" {
+		name = feed.Label
+	}
+
+	writer.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	writer.Header().Set("Cache-Control", "private, no-cache")
+	if err := db.WriteICalendar(writer, name, runs, now); err != nil {
+		log.Println(err)
+	}
+}
+
+// runsCSVHandler downloads the completed focus runs of the authenticated user
+// as CSV.
+type runsCSVHandler struct{}
+
+func (handler *runsCSVHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	query := request.URL.Query()
+
+	location := time.UTC
+	if name := query.Get("tz"); name != "" {
+		var err error
+		location, err = time.LoadLocation(name)
+		if err != nil {
+			http.Error(writer, "couldn't parse the timezone", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	start, end, err := db.ExportRange(query.Get("from"), query.Get("to"), location, now)
+	if err != nil {
+		writeCalendarError(writer, err)
+		return
+	}
+
+	runs, err := db.ExportRuns(userID, query.Get("timer"), start, end, now)
+	if err != nil {
+		writeCalendarError(writer, err)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writer.Header().Set("Content-Disposition", `attachment; filename="flowey-runs.csv"`)
+	if err := db.WriteRunsCSV(writer, runs, location, now); err != nil {
+		log.Println(err)
+	}
+}
+
+func (handler *runsCSVHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *runsCSVHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
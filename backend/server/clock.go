@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"flowey/jsonpatch"
+	"flowey/timer"
+)
+
+var implausibleTime = errors.New("implausible time")
+
+// clientTimePayload starts a clock synchronization: T0 is the client time the
+// request was sent at, in milliseconds since the Unix epoch.
+type clientTimePayload struct {
+	T0 int64 `json:"t0"`
+}
+
+// timePayload answers it with the server times the request was received (T1)
+// and the reply sent (T2) at. With the time T3 the reply arrives at, the client
+// computes its offset as ((T1 - T0) + (T2 - T3)) / 2 and the round trip as
+// (T3 - T0) - (T2 - T1). Offset is the server's own estimate, if it has one.
+type timePayload struct {
+	T0     int64  `json:"t0"`
+	T1     int64  `json:"t1"`
+	T2     int64  `json:"t2"`
+	Offset *int64 `json:"offset,omitempty"`
+}
+
+// clockOffset is how far a client clock is behind the server clock, in
+// milliseconds, as seen from the server.
+func (connection *connection) clockOffset() (int64, bool) {
+	if !connection.offsetKnown.Load() {
+		return 0, false
+	}
+	return connection.offset.Load(), true
+}
+
+// serverTime converts a client time to the server clock.
+func (connection *connection) serverTime(clientTime int64) int64 {
+	offset, _ := connection.clockOffset()
+	return clientTime + offset
+}
+
+func (connection *connection) handleTime(message envelope, receivedAt time.Time) error {
+	var payload clientTimePayload
+	if err := json.Unmarshal(message.Payload, &payload); err != nil || payload.T0 <= 0 {
+		return connection.reject(
+			message.ID, errorInvalidMessage,
+			"a time request needs a t0",
+			websocket.StatusInvalidFramePayloadData,
+		)
+	}
+	connection.malformedFrames = 0
+
+	// Without the arrival time of the reply the server can only assume that
+	// the request took half of the last ping round trip.
+	t1 := receivedAt.UnixMilli()
+	oneWay := int64(0)
+	if latency := connection.latency.Load(); latency >= 0 {
+		oneWay = time.Duration(latency).Milliseconds() / 2
+	}
+	offset := t1 - (payload.T0 + oneWay)
+	connection.offset.Store(offset)
+	connection.offsetKnown.Store(true)
+
+	return connection.send(messageTime, message.ID, timePayload{
+		T0:     payload.T0,
+		T1:     t1,
+		T2:     time.Now().UnixMilli(),
+		Offset: &offset,
+	})
+}
+
+// checkActionTime converts the client time of an action to the server clock
+// and rejects it if it's too far from now to be a live action.
+func checkActionTime(at int64, offset int64, maxError time.Duration) (int64, error) {
+	if at == 0 {
+		return 0, nil
+	}
+
+	at += offset
+	difference := time.Duration(at-time.Now().UnixMilli()) * time.Millisecond
+	if difference > maxError {
+		return 0, fmt.Errorf("%w: the action is %v in the future", implausibleTime, difference.Round(time.Second))
+	}
+	if difference < -maxError {
+		return 0, fmt.Errorf("%w: the action is %v in the past", implausibleTime, (-difference).Round(time.Second))
+	}
+
+	return at, nil
+}
+
+// checkTargetDate rejects target dates further in the future than any timer
+// can run.
+func checkTargetDate(targetDate float64, offset int64, maxError time.Duration) error {
+	latest := time.Now().UnixMilli() + timer.MaxMaxTime + maxError.Milliseconds()
+	if targetDate+float64(offset) > float64(latest) {
+		return fmt.Errorf("%w: targetDate is further away than the longest timer", implausibleTime)
+	}
+	return nil
+}
+
+func (connection *connection) checkState(stateString string) error {
+	var state struct {
+		TargetDate *float64 `json:"targetDate"`
+	}
+	if err := json.Unmarshal([]byte(stateString), &state); err != nil || state.TargetDate == nil {
+		return nil
+	}
+
+	offset, _ := connection.clockOffset()
+	return checkTargetDate(*state.TargetDate, offset, connection.maxClockError)
+}
+
+func (connection *connection) checkPatch(patch jsonpatch.Patch) error {
+	offset, _ := connection.clockOffset()
+	for _, operation := range patch {
+		if operation.Path != "/targetDate" || (operation.Op != "add" && operation.Op != "replace") {
+			continue
+		}
+
+		var targetDate float64
+		if err := json.Unmarshal(operation.Value, &targetDate); err != nil {
+			continue
+		}
+		if err := checkTargetDate(targetDate, offset, connection.maxClockError); err != nil {
+			return err
+		}
+	}
+	return nil
+}
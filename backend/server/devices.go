@@ -0,0 +1,141 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxDeviceNameLength     = 64
+	maxDevicePlatformLength = 32
+)
+
+// device is what a client announces about itself with the device and platform
+// query parameters when it connects. id is an opaque name of the connection.
+type device struct {
+	id       string
+	name     string
+	platform string
+}
+
+func validDeviceField(value string, maxLength int) bool {
+	return len(value) <= maxLength && utf8.ValidString(value) && !strings.ContainsFunc(value, unicode.IsControl)
+}
+
+func requestDevice(request *http.Request) (device, error) {
+	query := request.URL.Query()
+	name := strings.TrimSpace(query.Get("device"))
+	platform := strings.TrimSpace(query.Get("platform"))
+
+	if !validDeviceField(name, maxDeviceNameLength) {
+		return device{}, fmt.Errorf("the device name must be at most %d bytes of printable text", maxDeviceNameLength)
+	}
+	if !validDeviceField(platform, maxDevicePlatformLength) {
+		return device{}, fmt.Errorf("the platform must be at most %d bytes of printable text", maxDevicePlatformLength)
+	}
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return device{}, err
+	}
+
+	return device{
+		id:       base64.RawURLEncoding.EncodeToString(id),
+		name:     name,
+		platform: platform,
+	}, nil
+}
+
+type presenceEvent string
+
+const (
+	presenceJoin  presenceEvent = "join"
+	presenceLeave presenceEvent = "leave"
+)
+
+// presencePayload tells the other connections of a user that a device joined
+// or left.
+type presencePayload struct {
+	Event  presenceEvent  `json:"event"`
+	Device connectionInfo `json:"device"`
+}
+
+// devicesHandler lists the open websocket and event stream connections of the
+// authenticated user, with the device they announced and the last measured
+// ping round-trip time.
+type devicesHandler struct {
+	hubs *hubs
+}
+
+func (handler *devicesHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(handler.hubs.list(userID))
+}
+
+func (handler *devicesHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *devicesHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// deviceHandler disconnects one connection of the authenticated user.
+type deviceHandler struct {
+	hubs *hubs
+}
+
+func (handler *deviceHandler) handleDelete(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	if !handler.hubs.disconnect(userID, request.PathValue("id"), "disconnected remotely") {
+		http.Error(writer, "no such device", http.StatusNotFound)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *deviceHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *deviceHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodDelete:
+		handler.handleDelete(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
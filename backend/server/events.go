@@ -0,0 +1,264 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"flowey/db"
+)
+
+const eventsKeepAliveInterval = 30 * time.Second
+
+type eventStream struct {
+	writer  http.ResponseWriter
+	request *http.Request
+	flusher http.Flusher
+	outbox  *outbox
+	done    chan struct{}
+	once    sync.Once
+	mutex   sync.Mutex
+
+	subscribed   subscription
+	device       device
+	connectedAt  time.Time
+	lastActivity time.Time
+}
+
+func (stream *eventStream) write(message []byte) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	if _, err := stream.writer.Write(message); err != nil {
+		return err
+	}
+	stream.flusher.Flush()
+	stream.lastActivity = time.Now()
+	return nil
+}
+
+func (stream *eventStream) info() connectionInfo {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	return connectionInfo{
+		ID:           stream.device.id,
+		Device:       stream.device.name,
+		Platform:     stream.device.platform,
+		RemoteAddr:   stream.request.RemoteAddr,
+		Protocol:     "sse",
+		ConnectedAt:  stream.connectedAt,
+		LastActivity: stream.lastActivity,
+		Timer:        stream.subscribed.timer,
+		Room:         stream.subscribed.room,
+	}
+}
+
+func (stream *eventStream) subscription() subscription {
+	return stream.subscribed
+}
+
+func (stream *eventStream) sendState(update stateUpdate) {
+	message := fmt.Sprintf("id: %d\nevent: state\ndata: %s\n\n", update.revision, update.stateString)
+	if !stream.outbox.push([]byte(message)) {
+		log.Printf("dropping a slow event stream with %v", stream.request.RemoteAddr)
+		stream.close("outbound queue overflow")
+	}
+}
+
+func (stream *eventStream) sendPresence(payload presencePayload) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	message := fmt.Sprintf("event: presence\ndata: %s\n\n", data)
+	if !stream.outbox.push([]byte(message)) {
+		log.Printf("dropping a slow event stream with %v", stream.request.RemoteAddr)
+		stream.close("outbound queue overflow")
+	}
+}
+
+func (stream *eventStream) close(_ string) {
+	stream.once.Do(func() {
+		close(stream.done)
+	})
+}
+
+func (stream *eventStream) revoke(reason string) {
+	stream.close(reason)
+}
+
+type eventsHandler struct {
+	config    Config
+	hubs      *hubs
+	waitGroup sync.WaitGroup
+}
+
+func (handler *eventsHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticateWithCookie(writer, request)
+	if !ok {
+		return
+	}
+
+	subscription, ok := requestSubscription(writer, request, userID)
+	if !ok {
+		return
+	}
+	subscription.session, _ = requestToken(request)
+
+	device, err := requestDevice(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	handler.stream(writer, request, subscription, device)
+}
+
+// stream sends the state updates of the subscribed timer until the client goes
+// away or the stream is closed.
+func (handler *eventsHandler) stream(writer http.ResponseWriter, request *http.Request, subscription subscription, device device) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	handler.waitGroup.Add(1)
+	defer handler.waitGroup.Done()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+
+	now := time.Now()
+	stream := eventStream{
+		writer:       writer,
+		request:      request,
+		flusher:      flusher,
+		outbox:       newOutbox(handler.config.QueueSize, handler.config.SlowClientPolicy),
+		subscribed:   subscription,
+		device:       device,
+		done:         make(chan struct{}),
+		connectedAt:  now,
+		lastActivity: now,
+	}
+
+	timerHub := handler.hubs.acquire(subscription.key)
+	defer handler.hubs.release(timerHub)
+	defer timerHub.leave(&stream)
+	defer subscription.expire(&stream)()
+
+	log.Printf("opened an event stream with %v", request.RemoteAddr)
+
+	lastEventID, err := strconv.ParseInt(request.Header.Get("Last-Event-ID"), 10, 64)
+	if err != nil {
+		lastEventID = -1
+	}
+
+	if _, _, err := timerHub.joinAt(&stream, lastEventID, stream.outbox.replayLimit()); err != nil {
+		log.Println(err)
+		return
+	}
+	handler.hubs.announce(&stream, presenceJoin)
+	defer handler.hubs.announce(&stream, presenceLeave)
+
+	ticker := time.NewTicker(eventsKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message := <-stream.outbox.messages:
+			if err := stream.write(message); err != nil {
+				log.Println(err)
+				return
+			}
+		case <-ticker.C:
+			if err := stream.write([]byte(": keepalive\n\n")); err != nil {
+				log.Println(err)
+				return
+			}
+		case <-stream.done:
+			return
+		case <-request.Context().Done():
+			log.Printf("closed an event stream with %v", request.RemoteAddr)
+			return
+		}
+	}
+}
+
+func (handler *eventsHandler) handlePost(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	subscription, ok := requestSubscription(writer, request, userID)
+	if !ok {
+		return
+	}
+
+	body, ok := readBody(writer, request)
+	if !ok {
+		return
+	}
+
+	push, update, err := handler.hubs.submit(subscription.key, chooseState(subscription, requestOrigin("http", request), string(body)))
+	if err != nil {
+		switch {
+		case errors.Is(err, db.Forbidden):
+			http.Error(writer, err.Error(), http.StatusForbidden)
+		case errors.Is(err, db.NoSuchRoom):
+			http.Error(writer, err.Error(), http.StatusNotFound)
+		case errors.Is(err, db.InvalidState), errors.Is(err, db.MissingVersion):
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, db.StateTooLarge):
+			http.Error(writer, err.Error(), http.StatusRequestEntityTooLarge)
+		default:
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !push && update.stateString == "" {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	io.WriteString(writer, update.stateString)
+}
+
+func (handler *eventsHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Last-Event-ID")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *eventsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodPost:
+		handler.handlePost(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (handler *eventsHandler) close() {
+	handler.waitGroup.Wait()
+}
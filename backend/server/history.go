@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"flowey/db"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+type historyHandler struct{}
+
+func (handler *historyHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	subscription, ok := requestSubscription(writer, request, userID)
+	if !ok {
+		return
+	}
+
+	query := request.URL.Query()
+
+	limit := defaultHistoryLimit
+	if limitString := query.Get("limit"); limitString != "" {
+		var err error
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit <= 0 {
+			http.Error(writer, "couldn't parse the limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, maxHistoryLimit)
+	}
+
+	var before db.Revision
+	if beforeString := query.Get("before"); beforeString != "" {
+		var err error
+		before, err = strconv.ParseInt(beforeString, 10, 64)
+		if err != nil {
+			http.Error(writer, "couldn't parse the revision", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := db.StateHistory(subscription.key, before, limit)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(entries)
+}
+
+func (handler *historyHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *historyHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// parseTime accepts RFC 3339 times as well as milliseconds since the Unix
+// epoch, the format of targetDate.
+func parseTime(value string) (time.Time, bool) {
+	if milliseconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(milliseconds), true
+	}
+
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return at, true
+}
+
+// restoreHandler serves both undo and point-in-time restore, which differ
+// only in which revision of the history they bring back.
+type restoreHandler struct {
+	hubs *hubs
+	undo bool
+}
+
+func (handler *restoreHandler) handlePost(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	subscription, ok := requestSubscription(writer, request, userID)
+	if !ok {
+		return
+	}
+
+	var at time.Time
+	if !handler.undo {
+		at, ok = parseTime(request.URL.Query().Get("at"))
+		if !ok {
+			http.Error(writer, "couldn't parse the time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	origin := requestOrigin("http", request)
+	_, update, err := handler.hubs.submit(subscription.key, subscription.control(func() (bool, stateUpdate, error) {
+		var stateString string
+		var revision db.Revision
+		var err error
+		if handler.undo {
+			stateString, revision, err = db.UndoState(subscription.key, origin)
+		} else {
+			stateString, revision, err = db.RestoreState(subscription.key, origin, at)
+		}
+		return err == nil, stateUpdate{stateString: stateString, revision: revision}, err
+	}))
+	if err != nil {
+		switch {
+		case errors.Is(err, db.Forbidden):
+			http.Error(writer, err.Error(), http.StatusForbidden)
+		case errors.Is(err, db.NoSuchRoom):
+			http.Error(writer, err.Error(), http.StatusNotFound)
+		case errors.Is(err, db.NoHistory) && handler.undo:
+			http.Error(writer, "there is nothing to undo", http.StatusConflict)
+		case errors.Is(err, db.NoHistory):
+			http.Error(writer, err.Error(), http.StatusNotFound)
+		case errors.Is(err, db.InvalidState), errors.Is(err, db.StateTooLarge):
+			http.Error(writer, err.Error(), http.StatusConflict)
+		default:
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	writeState(writer, http.StatusOK, update.stateString, update.revision)
+}
+
+func (handler *restoreHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	writer.Header().Set("Access-Control-Expose-Headers", "ETag")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *restoreHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodPost:
+		handler.handlePost(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
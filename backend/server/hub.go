@@ -0,0 +1,497 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"flowey/db"
+)
+
+type connectionInfo struct {
+	ID           string    `json:"id"`
+	Device       string    `json:"device,omitempty"`
+	Platform     string    `json:"platform,omitempty"`
+	RemoteAddr   string    `json:"remoteAddr"`
+	Protocol     string    `json:"protocol"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+	LastActivity time.Time `json:"lastActivity"`
+	Timer        string    `json:"timer"`
+	Room         db.RoomID `json:"room,omitempty"`
+	LatencyMs    *float64  `json:"latencyMs,omitempty"`
+	// ClockOffsetMs is how far the client clock is behind the server clock.
+	ClockOffsetMs *int64 `json:"clockOffsetMs,omitempty"`
+}
+
+// stateUpdate is a state at a given revision. If the state was reached by
+// patching the previous revision, patch holds the JSON Patch that did it.
+type stateUpdate struct {
+	stateString string
+	revision    db.Revision
+	patch       json.RawMessage
+}
+
+// subscription is the timer a client follows: one of its own, the shared
+// timer of a room it's a member of, or a timer shared with a spectator token.
+// Spectators have no user or session and lose access at expiresAt, if it's
+// set.
+type subscription struct {
+	key       db.StateKey
+	userID    db.UserID
+	timer     string
+	room      db.RoomID
+	share     db.ShareID
+	expiresAt time.Time
+	session   string
+}
+
+// control guards a decision that changes the state: spectators may not make
+// it, and in a room only members whose current role allows it may.
+func (subscription subscription) control(decide stateDecision) stateDecision {
+	if subscription.share != 0 {
+		return func() (bool, stateUpdate, error) {
+			return false, stateUpdate{}, fmt.Errorf("%w: spectators can't change the timer", db.Forbidden)
+		}
+	}
+
+	if subscription.room == 0 {
+		return decide
+	}
+
+	return func() (bool, stateUpdate, error) {
+		if err := db.CanControlRoom(subscription.userID, subscription.room); err != nil {
+			return false, stateUpdate{}, err
+		}
+		return decide()
+	}
+}
+
+// expire closes the connection of a spectator when its share expires. The
+// returned function cancels it.
+func (subscription subscription) expire(subscriber subscriber) (stop func() bool) {
+	if subscription.expiresAt.IsZero() {
+		return func() bool { return false }
+	}
+
+	timer := time.AfterFunc(time.Until(subscription.expiresAt), func() {
+		subscriber.close("share expired")
+	})
+	return timer.Stop
+}
+
+// subscriber is a live connection that receives state broadcasts. sendState
+// must not block: implementations queue the state and write it from their own
+// goroutine.
+type subscriber interface {
+	sendState(update stateUpdate)
+	close(reason string)
+	revoke(reason string)
+	sendPresence(payload presencePayload)
+	info() connectionInfo
+	subscription() subscription
+}
+
+// stateDecision reads, compares and stores the state of a single timer. It
+// reports whether the resulting state must be broadcast.
+type stateDecision func() (push bool, update stateUpdate, err error)
+
+// requestOrigin describes the client behind a request for the state history.
+func requestOrigin(protocol string, request *http.Request) string {
+	return fmt.Sprintf("%s %s", protocol, request.RemoteAddr)
+}
+
+// chooseState is the decision for a full state sent by a client.
+func chooseState(subscription subscription, origin string, clientStateString string) stateDecision {
+	return subscription.control(func() (bool, stateUpdate, error) {
+		push, stateString, revision, err := db.ChooseState(subscription.key, origin, clientStateString)
+		return push, stateUpdate{stateString: stateString, revision: revision}, err
+	})
+}
+
+// applyAction is the decision for a timer action sent by a client.
+func applyAction(subscription subscription, origin string, payload actionPayload) stateDecision {
+	return subscription.control(func() (bool, stateUpdate, error) {
+		at := payload.At
+		if at == 0 {
+			at = time.Now().UnixMilli()
+		}
+
+		push, stateString, revision, err := db.ApplyAction(subscription.key, origin, payload.Action, at)
+		return push, stateUpdate{stateString: stateString, revision: revision}, err
+	})
+}
+
+type hubRequest struct {
+	decide stateDecision
+	result chan hubResult
+}
+
+type hubResult struct {
+	push   bool
+	update stateUpdate
+	err    error
+}
+
+type resumeStatus string
+
+const (
+	resumeCurrent  resumeStatus = "current"
+	resumeUpdates  resumeStatus = "updates"
+	resumeSnapshot resumeStatus = "snapshot"
+)
+
+// hub serializes the state decisions of a single timer and fans the results
+// out to the timer's subscribers. It runs for as long as anyone holds a
+// reference to it.
+type hub struct {
+	key         db.StateKey
+	journal     *journal
+	requests    chan hubRequest
+	subscribers map[subscriber]bool
+	mutex       sync.RWMutex
+	refs        int
+}
+
+func newHub(key db.StateKey, journal *journal) *hub {
+	return &hub{
+		key:         key,
+		journal:     journal,
+		requests:    make(chan hubRequest),
+		subscribers: make(map[subscriber]bool),
+	}
+}
+
+func (hub *hub) run() {
+	for request := range hub.requests {
+		push, update, err := request.decide()
+		if err == nil && push {
+			hub.journal.append(update)
+			hub.broadcast(update)
+		}
+		request.result <- hubResult{push, update, err}
+	}
+}
+
+// submit runs decide on the hub goroutine, broadcasts its result if needed and
+// returns it to the caller.
+func (hub *hub) submit(decide stateDecision) (push bool, update stateUpdate, err error) {
+	request := hubRequest{decide: decide, result: make(chan hubResult, 1)}
+	hub.requests <- request
+	result := <-request.result
+	return result.push, result.update, result.err
+}
+
+func (hub *hub) broadcast(update stateUpdate) {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	for subscriber := range hub.subscribers {
+		subscriber.sendState(update)
+	}
+}
+
+// resume sends the subscriber whatever it missed since the given revision:
+// nothing, the journaled states in between, or the current state if the
+// journal doesn't reach back that far or there are more than limit states to
+// replay. It must run on the hub goroutine.
+func (hub *hub) resume(subscriber subscriber, revision db.Revision, limit int) (resumeStatus, db.Revision, error) {
+	stateString, current, err := db.GetStateRevision(hub.key)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if revision == current {
+		return resumeCurrent, current, nil
+	}
+
+	if revision < current {
+		if entries, ok := hub.journal.since(revision, current); ok && len(entries) <= limit {
+			for _, entry := range entries {
+				subscriber.sendState(entry)
+			}
+			return resumeUpdates, current, nil
+		}
+	}
+
+	if stateString != "" {
+		subscriber.sendState(stateUpdate{stateString: stateString, revision: current})
+	}
+	return resumeSnapshot, current, nil
+}
+
+// joinAt adds the subscriber to the hub and catches it up from the given
+// revision, with no broadcast slipping in between.
+func (hub *hub) joinAt(subscriber subscriber, revision db.Revision, limit int) (status resumeStatus, current db.Revision, err error) {
+	_, _, err = hub.submit(func() (bool, stateUpdate, error) {
+		hub.join(subscriber)
+
+		var err error
+		status, current, err = hub.resume(subscriber, revision, limit)
+		return false, stateUpdate{}, err
+	})
+	return status, current, err
+}
+
+func (hub *hub) join(subscriber subscriber) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.subscribers[subscriber] = true
+}
+
+func (hub *hub) leave(subscriber subscriber) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	delete(hub.subscribers, subscriber)
+}
+
+// matching returns the subscribers that match.
+func (hub *hub) matching(match func(subscription) bool) []subscriber {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	subscribers := []subscriber{}
+	for subscriber := range hub.subscribers {
+		if match(subscriber.subscription()) {
+			subscribers = append(subscribers, subscriber)
+		}
+	}
+	return subscribers
+}
+
+// kick closes the connections of the subscribers that match. They're closed
+// without holding the mutex, so that a slow connection can't stall the hub.
+func (hub *hub) kick(match func(subscription) bool, reason string) {
+	for _, subscriber := range hub.matching(match) {
+		subscriber.close(reason)
+	}
+}
+
+func (hub *hub) close(reason string) {
+	hub.kick(func(subscription) bool { return true }, reason)
+}
+
+// journalIdleTimeout is how long the journal of a timer nobody is connected
+// to is kept for clients that come back.
+const journalIdleTimeout = 10 * time.Minute
+
+type hubs struct {
+	dict        map[db.StateKey]*hub
+	journals    map[db.StateKey]*journal
+	evictions   map[db.StateKey]*time.Timer
+	journalSize int
+	mutex       sync.Mutex
+}
+
+func newHubs(journalSize int) hubs {
+	return hubs{
+		dict:        make(map[db.StateKey]*hub),
+		journals:    make(map[db.StateKey]*journal),
+		evictions:   make(map[db.StateKey]*time.Timer),
+		journalSize: journalSize,
+	}
+}
+
+// acquire returns the hub of the timer, starting it if needed. Every call
+// must be paired with a call to release.
+func (hubs *hubs) acquire(key db.StateKey) *hub {
+	hubs.mutex.Lock()
+	defer hubs.mutex.Unlock()
+
+	timerHub, ok := hubs.dict[key]
+	if !ok {
+		hubs.cancelEviction(key)
+
+		timerJournal, ok := hubs.journals[key]
+		if !ok {
+			timerJournal = newJournal(hubs.journalSize)
+			hubs.journals[key] = timerJournal
+		}
+
+		timerHub = newHub(key, timerJournal)
+		hubs.dict[key] = timerHub
+		go timerHub.run()
+	}
+	timerHub.refs++
+
+	return timerHub
+}
+
+func (hubs *hubs) release(timerHub *hub) {
+	hubs.mutex.Lock()
+	defer hubs.mutex.Unlock()
+
+	timerHub.refs--
+	if timerHub.refs > 0 {
+		return
+	}
+
+	delete(hubs.dict, timerHub.key)
+	close(timerHub.requests)
+
+	key := timerHub.key
+	var eviction *time.Timer
+	eviction = time.AfterFunc(journalIdleTimeout, func() {
+		hubs.mutex.Lock()
+		defer hubs.mutex.Unlock()
+
+		if hubs.evictions[key] == eviction {
+			delete(hubs.evictions, key)
+			delete(hubs.journals, key)
+		}
+	})
+	hubs.evictions[key] = eviction
+}
+
+// cancelEviction keeps the journal of a timer that's in use again. The
+// caller holds the mutex.
+func (hubs *hubs) cancelEviction(key db.StateKey) {
+	if eviction, ok := hubs.evictions[key]; ok {
+		eviction.Stop()
+		delete(hubs.evictions, key)
+	}
+}
+
+// submit runs decide on the hub of the timer. It is meant for requests that
+// don't hold on to the hub, such as plain HTTP requests.
+func (hubs *hubs) submit(key db.StateKey, decide stateDecision) (push bool, update stateUpdate, err error) {
+	timerHub := hubs.acquire(key)
+	defer hubs.release(timerHub)
+
+	return timerHub.submit(decide)
+}
+
+// matching returns the connections to any timer that match.
+func (hubs *hubs) matching(match func(subscription) bool) []subscriber {
+	hubs.mutex.Lock()
+	defer hubs.mutex.Unlock()
+
+	subscribers := []subscriber{}
+	for _, timerHub := range hubs.dict {
+		subscribers = append(subscribers, timerHub.matching(match)...)
+	}
+	return subscribers
+}
+
+// userSubscribers returns the connections of the user across all of its
+// timers and rooms.
+func (hubs *hubs) userSubscribers(userID db.UserID) []subscriber {
+	return hubs.matching(func(subscription subscription) bool {
+		return subscription.userID == userID
+	})
+}
+
+func (hubs *hubs) list(userID db.UserID) []connectionInfo {
+	infos := []connectionInfo{}
+	for _, subscriber := range hubs.userSubscribers(userID) {
+		infos = append(infos, subscriber.info())
+	}
+
+	slices.SortFunc(infos, func(a, b connectionInfo) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+
+	return infos
+}
+
+// forget closes the connections to a deleted timer and drops its journal, so
+// that a new timer can't resume from it.
+func (hubs *hubs) forget(key db.StateKey) {
+	hubs.mutex.Lock()
+	timerHub, ok := hubs.dict[key]
+	hubs.cancelEviction(key)
+	delete(hubs.journals, key)
+	hubs.mutex.Unlock()
+
+	if ok {
+		timerHub.close("timer deleted")
+	}
+}
+
+// announce tells the other connections of the user that one of its devices
+// joined or left. Spectators have no user and aren't announced.
+func (hubs *hubs) announce(subscriber subscriber, event presenceEvent) {
+	userID := subscriber.subscription().userID
+	if subscriber.subscription().share != 0 {
+		return
+	}
+
+	payload := presencePayload{Event: event, Device: subscriber.info()}
+	for _, other := range hubs.userSubscribers(userID) {
+		if other != subscriber {
+			other.sendPresence(payload)
+		}
+	}
+}
+
+// disconnect closes the connection of the user with the given id.
+func (hubs *hubs) disconnect(userID db.UserID, id string, reason string) bool {
+	for _, subscriber := range hubs.userSubscribers(userID) {
+		if subscriber.info().ID == id {
+			subscriber.close(reason)
+			return true
+		}
+	}
+	return false
+}
+
+// sessions returns the session tokens the connections to any timer were made
+// with, once each.
+func (hubs *hubs) sessions() []string {
+	hubs.mutex.Lock()
+	defer hubs.mutex.Unlock()
+
+	seen := make(map[string]bool)
+	sessions := []string{}
+	for _, timerHub := range hubs.dict {
+		timerHub.mutex.RLock()
+		for subscriber := range timerHub.subscribers {
+			if session := subscriber.subscription().session; session != "" && !seen[session] {
+				seen[session] = true
+				sessions = append(sessions, session)
+			}
+		}
+		timerHub.mutex.RUnlock()
+	}
+
+	return sessions
+}
+
+// revoke closes the matching connections to any timer with a policy violation,
+// such as those of a session that logged out.
+func (hubs *hubs) revoke(match func(subscription) bool, reason string) {
+	for _, subscriber := range hubs.matching(match) {
+		subscriber.revoke(reason)
+	}
+}
+
+// kick closes the matching connections to a timer, such as those of a member
+// that left a room.
+func (hubs *hubs) kick(key db.StateKey, match func(subscription) bool, reason string) {
+	hubs.mutex.Lock()
+	timerHub, ok := hubs.dict[key]
+	hubs.mutex.Unlock()
+
+	if ok {
+		timerHub.kick(match, reason)
+	}
+}
+
+func (hubs *hubs) close() {
+	hubs.mutex.Lock()
+	timerHubs := make([]*hub, 0, len(hubs.dict))
+	for _, timerHub := range hubs.dict {
+		timerHubs = append(timerHubs, timerHub)
+	}
+	hubs.mutex.Unlock()
+
+	for _, timerHub := range timerHubs {
+		timerHub.close("server shutting down")
+	}
+	log.Printf("closed the connections to %d timers", len(timerHubs))
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"flowey/db"
+	"flowey/jobs"
+)
+
+const (
+	pruneJobsKind = "jobs.prune"
+	// jobRetention is how long finished jobs stay listed.
+	jobRetention = 7 * 24 * time.Hour
+)
+
+// newJobRunner returns a runner for the jobs of the server: pruning finished
+// jobs every day and sending the push messages of finished timers.
+func newJobRunner(config Config) *jobs.Runner {
+	clock := config.Clock
+	if clock == nil {
+		clock = jobs.SystemClock{}
+	}
+
+	runner := jobs.NewRunner(clock)
+	runner.Handle(pruneJobsKind, func(ctx context.Context, job db.Job) error {
+		return pruneJobs(clock, job)
+	})
+
+	pusher := newPusher(config)
+	runner.Handle(db.PushFinishedJob, func(ctx context.Context, job db.Job) error {
+		return pusher.sendFinished(ctx, job, clock.Now())
+	})
+
+	job := db.NewJob{Kind: pruneJobsKind, Key: "daily", RunAt: clock.Now()}
+	if err := db.EnsureJob(job, clock.Now()); err != nil {
+		log.Println(err)
+	}
+	if err := db.QueueFinishedPushes(clock.Now()); err != nil {
+		log.Println(err)
+	}
+
+	return runner
+}
+
+// pruneJobs deletes the jobs that finished more than a week ago and queues
+// itself for the next day.
+func pruneJobs(clock jobs.Clock, job db.Job) error {
+	now := clock.Now()
+
+	pruned, err := db.PruneJobs(now.Add(-jobRetention))
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		log.Printf("pruned %d finished jobs", pruned)
+	}
+
+	next := db.NewJob{Kind: job.Kind, Key: job.Key, RunAt: now.Add(24 * time.Hour)}
+	_, err = db.EnqueueJob(next, now)
+	return err
+}
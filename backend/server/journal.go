@@ -0,0 +1,64 @@
+package server
+
+import (
+	"sync"
+
+	"flowey/db"
+)
+
+// journal remembers the most recent states of a user so that a reconnecting
+// client can catch up on the revisions it missed instead of refetching
+// everything. It outlives the hub of the user.
+type journal struct {
+	entries []stateUpdate
+	size    int
+	mutex   sync.Mutex
+}
+
+func newJournal(size int) *journal {
+	return &journal{size: size}
+}
+
+func (journal *journal) append(update stateUpdate) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	if journal.size <= 0 {
+		return
+	}
+
+	if length := len(journal.entries); length > 0 && journal.entries[length-1].revision >= update.revision {
+		return
+	}
+
+	journal.entries = append(journal.entries, update)
+	if len(journal.entries) > journal.size {
+		journal.entries = journal.entries[len(journal.entries)-journal.size:]
+	}
+}
+
+// since returns the states after the given revision up to and including the
+// current one. It reports false if any of them is missing from the journal.
+func (journal *journal) since(revision db.Revision, current db.Revision) ([]stateUpdate, bool) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	var entries []stateUpdate
+	expected := revision + 1
+	for _, entry := range journal.entries {
+		if entry.revision < expected {
+			continue
+		}
+		if entry.revision != expected {
+			return nil, false
+		}
+		entries = append(entries, entry)
+		expected++
+	}
+
+	if expected != current+1 {
+		return nil, false
+	}
+
+	return entries, true
+}
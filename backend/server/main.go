@@ -2,8 +2,11 @@ package server
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"time"
 
 	"flowey/db"
 	"flowey/utils"
@@ -19,6 +22,42 @@ func Main() error {
 	ip := flagSet.String("ip", "0.0.0.0", "ip to bind to")
 	path := flagSet.String("path", defaultPath, "path to the database file")
 	port := flagSet.Int("port", 80, "port to bind to")
+
+	var config Config
+	flagSet.DurationVar(&config.PingInterval, "ping-interval", 30*time.Second, "interval between websocket pings")
+	flagSet.DurationVar(&config.PongTimeout, "pong-timeout", 10*time.Second, "time to wait for a pong before dropping a websocket connection")
+	flagSet.DurationVar(&config.IdleTimeout, "idle-timeout", 2*time.Minute, "time without any inbound message before dropping a websocket connection; pongs don't count (0 disables)")
+
+	flagSet.DurationVar(&config.SessionCheckInterval, "session-check-interval", 2*time.Second, "how often to close connections whose session was ended by flowey db passwd or delete")
+
+	flagSet.IntVar(&config.QueueSize, "queue-size", 16, "number of outbound messages queued per connection")
+	config.SlowClientPolicy = DropOldest
+	flagSet.Var(&config.SlowClientPolicy, "slow-client", "what to do when a connection's queue is full (drop or disconnect)")
+
+	flagSet.IntVar(&config.JournalSize, "journal-size", 64, "number of recent states kept per user for resuming clients")
+	flagSet.DurationVar(&config.MaxClockError, "max-clock-error", 2*time.Minute, "how far client timestamps may be from the server clock after correcting for the measured offset")
+
+	flagSet.Func("credentialed-origin", "origin, like https://flowey.example.org, whose pages may use the session cookie (repeatable)", func(origin string) error {
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Path != "" {
+			return fmt.Errorf("%q isn't an origin", origin)
+		}
+		config.CredentialedOrigins = append(config.CredentialedOrigins, origin)
+		return nil
+	})
+
+	flagSet.DurationVar(&config.WebhookTimeout, "webhook-timeout", 10*time.Second, "time to wait for a webhook receiver to answer")
+	flagSet.BoolVar(&config.AllowLoopback, "allow-loopback", false, "let webhook deliveries and push messages reach loopback addresses, for development")
+	flagSet.DurationVar(&config.PushTimeout, "push-timeout", 10*time.Second, "time to wait for a push service to answer")
+
+	stateLimits := db.StateLimits{UnknownFields: db.KeepUnknownFields}
+	flagSet.IntVar(&stateLimits.MaxSize, "max-state-size", 16<<10, "largest state accepted, in bytes")
+	flagSet.Var(&stateLimits.UnknownFields, "unknown-fields", "what to do with state fields the server doesn't know (keep, drop or reject)")
+
+	var historyRetention db.HistoryRetention
+	flagSet.DurationVar(&historyRetention.MaxAge, "history-max-age", 30*24*time.Hour, "how long to keep old states for undo and restore (0 keeps them forever)")
+	flagSet.IntVar(&historyRetention.MaxEntries, "history-max-entries", 1000, "number of old states kept per user (0 keeps all)")
+
 	flagSet.Parse(os.Args[2:])
 
 	if flagSet.NArg() > 0 {
@@ -31,7 +70,26 @@ func Main() error {
 	}
 	defer db.Close()
 
-	server := NewServer(*ip, *port)
+	if config.PingInterval <= 0 {
+		log.Fatal("the ping interval must be positive")
+	}
+	if config.PongTimeout <= 0 {
+		log.Fatal("the pong timeout must be positive")
+	}
+	if config.SessionCheckInterval <= 0 {
+		log.Fatal("the session check interval must be positive")
+	}
+	if config.QueueSize <= 0 {
+		log.Fatal("the queue size must be positive")
+	}
+	if stateLimits.MaxSize <= 0 {
+		log.Fatal("the maximum state size must be positive")
+	}
+	db.SetStateLimits(stateLimits)
+	db.SetMaxClockError(config.MaxClockError)
+	db.SetHistoryRetention(historyRetention)
+
+	server := NewServer(*ip, *port, config)
 	err = server.ListenAndServe()
 	if err != nil {
 		return err
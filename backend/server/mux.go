@@ -1,24 +1,127 @@
 package server
 
-import "net/http"
+import (
+	"net/http"
+
+	"flowey/jobs"
+)
 
 type ServeMux struct {
 	http.ServeMux
 
-	session sessionHandler
-	ws      *wsHandler
+	action      actionHandler
+	calendar    calendarHandler
+	calendars   calendarsHandler
+	device      deviceHandler
+	devices     devicesHandler
+	events      eventsHandler
+	feed        calendarFeedHandler
+	history     historyHandler
+	pushKey     pushKeyHandler
+	pushSub     pushSubscriptionHandler
+	pushSubs    pushSubscriptionsHandler
+	restore     restoreHandler
+	room        roomHandler
+	roomMember  roomMemberHandler
+	roomMembers roomMembersHandler
+	rooms       roomsHandler
+	runsCSV     runsCSVHandler
+	session     sessionHandler
+	sessionAll  sessionHandler
+	sessionByID sessionByIDHandler
+	sessions    sessionsHandler
+	share       shareHandler
+	shares      sharesHandler
+	spectator   spectatorHandler
+	state       stateHandler
+	stats       statsHandler
+	timer       timerHandler
+	timers      timersHandler
+	undo        restoreHandler
+	webhook     webhookHandler
+	deliveries  webhookDeliveriesHandler
+	webhookTest webhookTestHandler
+	webhooks    webhooksHandler
+	ws          *wsHandler
+	sender      *webhookSender
+	watcher     *sessionWatcher
+	jobs        *jobs.Runner
 }
 
-func NewServeMux() *ServeMux {
+func NewServeMux(config Config) *ServeMux {
+	setCredentialedOrigins(config.CredentialedOrigins)
 	mux := ServeMux{
-		ws: newWsHandler(),
+		ws:     newWsHandler(config),
+		sender: newWebhookSender(config),
+		jobs:   newJobRunner(config),
 	}
+	go mux.sender.run()
+	mux.watcher = newSessionWatcher(&mux.ws.hubs, config)
+	go mux.watcher.run()
+	mux.jobs.Start()
 	mux.Handle("/{$}", http.NotFoundHandler())
+	mux.action.config = config
+	mux.action.hubs = &mux.ws.hubs
+	mux.device.hubs = &mux.ws.hubs
+	mux.devices.hubs = &mux.ws.hubs
+	mux.events.hubs = &mux.ws.hubs
+	mux.events.config = config
+	mux.restore.hubs = &mux.ws.hubs
+	mux.room.hubs = &mux.ws.hubs
+	mux.roomMember.hubs = &mux.ws.hubs
+	mux.session.hubs = &mux.ws.hubs
+	mux.sessionAll.hubs = &mux.ws.hubs
+	mux.sessionAll.all = true
+	mux.sessionByID.hubs = &mux.ws.hubs
+	mux.share.hubs = &mux.ws.hubs
+	mux.spectator.events = &mux.events
+	mux.spectator.ws = mux.ws
+	mux.state.hubs = &mux.ws.hubs
+	mux.timer.hubs = &mux.ws.hubs
+	mux.undo.hubs = &mux.ws.hubs
+	mux.undo.undo = true
+	mux.Handle("/action/{$}", &mux.action)
+	mux.Handle("GET /calendar/{token}", &mux.feed)
+	mux.Handle("/calendars/{$}", &mux.calendars)
+	mux.Handle("/calendars/{id}", &mux.calendar)
+	mux.Handle("/connections/{$}", &mux.devices)
+	mux.Handle("/devices/{$}", &mux.devices)
+	mux.Handle("/devices/{id}", &mux.device)
+	mux.Handle("/events/{$}", &mux.events)
+	mux.Handle("/push/key", &mux.pushKey)
+	mux.Handle("/push/subscriptions/{$}", &mux.pushSubs)
+	mux.Handle("/push/subscriptions/{id}", &mux.pushSub)
+	mux.Handle("/rooms/{$}", &mux.rooms)
+	mux.Handle("/rooms/{id}", &mux.room)
+	mux.Handle("/rooms/{id}/members/{$}", &mux.roomMembers)
+	mux.Handle("/rooms/{id}/members/{username}", &mux.roomMember)
+	mux.Handle("/runs/csv", &mux.runsCSV)
 	mux.Handle("/session/{$}", &mux.session)
+	mux.Handle("/session/all", &mux.sessionAll)
+	mux.Handle("/sessions/{$}", &mux.sessions)
+	mux.Handle("/sessions/{id}", &mux.sessionByID)
+	mux.Handle("GET /share/{token}", &mux.spectator)
+	mux.Handle("/shares/{$}", &mux.shares)
+	mux.Handle("/shares/{id}", &mux.share)
+	mux.Handle("/state/{$}", &mux.state)
+	mux.Handle("/state/history", &mux.history)
+	mux.Handle("/state/restore", &mux.restore)
+	mux.Handle("/state/undo", &mux.undo)
+	mux.Handle("/stats/{$}", &mux.stats)
+	mux.Handle("/timers/{$}", &mux.timers)
+	mux.Handle("/timers/{name}", &mux.timer)
+	mux.Handle("/webhooks/{$}", &mux.webhooks)
+	mux.Handle("/webhooks/{id}", &mux.webhook)
+	mux.Handle("/webhooks/{id}/deliveries", &mux.deliveries)
+	mux.Handle("/webhooks/{id}/test", &mux.webhookTest)
 	mux.Handle("GET /ws/{$}", mux.ws)
 	return &mux
 }
 
 func (s *ServeMux) close() {
+	s.watcher.close()
 	s.ws.close()
+	s.events.close()
+	s.sender.close()
+	s.jobs.Close()
 }
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+)
+
+type SlowClientPolicy string
+
+const (
+	// DropOldest discards the oldest queued message to make room for a new
+	// one, whatever its type. A slow client still ends up with the latest
+	// state, but may lose older states, presence updates and the acks and
+	// errors answering its requests, so it must time out requests itself.
+	DropOldest SlowClientPolicy = "drop"
+	// Disconnect closes the connection of a client that can't keep up.
+	Disconnect SlowClientPolicy = "disconnect"
+)
+
+func (policy *SlowClientPolicy) String() string {
+	return string(*policy)
+}
+
+func (policy *SlowClientPolicy) Set(value string) error {
+	switch SlowClientPolicy(value) {
+	case DropOldest, Disconnect:
+		*policy = SlowClientPolicy(value)
+		return nil
+	default:
+		return fmt.Errorf("expected %q or %q", DropOldest, Disconnect)
+	}
+}
+
+// outbox is a bounded queue of outbound messages drained by the writer
+// goroutine of a single connection.
+type outbox struct {
+	messages chan []byte
+	policy   SlowClientPolicy
+	mutex    sync.Mutex
+}
+
+func newOutbox(size int, policy SlowClientPolicy) *outbox {
+	return &outbox{
+		messages: make(chan []byte, size),
+		policy:   policy,
+	}
+}
+
+// push queues the message without blocking. It reports false if the queue is
+// full and the policy asks for the client to be disconnected.
+func (outbox *outbox) push(message []byte) bool {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	select {
+	case outbox.messages <- message:
+		return true
+	default:
+	}
+
+	if outbox.policy == Disconnect {
+		return false
+	}
+
+	select {
+	case <-outbox.messages:
+	default:
+	}
+	outbox.messages <- message
+	return true
+}
+
+// replayLimit is the number of states that can be queued at once while
+// leaving room for a reply.
+func (outbox *outbox) replayLimit() int {
+	return cap(outbox.messages) - 1
+}
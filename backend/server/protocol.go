@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+
+	"flowey/db"
+	"flowey/jsonpatch"
+	"flowey/timer"
+)
+
+const (
+	protocolV1 = "flowey"
+	protocolV2 = "flowey.v2"
+)
+
+func supportedProtocol(protocol string) bool {
+	return protocol == protocolV1 || protocol == protocolV2
+}
+
+type messageType string
+
+const (
+	messageHello    messageType = "hello"
+	messageState    messageType = "state"
+	messageAck      messageType = "ack"
+	messageError    messageType = "error"
+	messageNotice   messageType = "notice"
+	messagePing     messageType = "ping"
+	messagePong     messageType = "pong"
+	messagePatch    messageType = "patch"
+	messageAction   messageType = "action"
+	messageTime     messageType = "time"
+	messagePresence messageType = "presence"
+)
+
+type envelope struct {
+	Type     messageType     `json:"type"`
+	ID       string          `json:"id,omitempty"`
+	Base     *db.Revision    `json:"base,omitempty"`
+	Revision *db.Revision    `json:"revision,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+type errorCode string
+
+const (
+	errorInvalidMessage    errorCode = "invalid_message"
+	errorInvalidState      errorCode = "invalid_state"
+	errorMissingVersion    errorCode = "missing_version"
+	errorStateTooLarge     errorCode = "state_too_large"
+	errorInvalidPatch      errorCode = "invalid_patch"
+	errorPatchConflict     errorCode = "patch_conflict"
+	errorUnknownAction     errorCode = "unknown_action"
+	errorInvalidTransition errorCode = "invalid_transition"
+	errorImplausibleTime   errorCode = "implausible_time"
+	errorForbidden         errorCode = "forbidden"
+	errorUnknownType       errorCode = "unknown_type"
+	errorUnsupportedData   errorCode = "unsupported_data"
+	errorInternal          errorCode = "internal_error"
+)
+
+func stateErrorCode(err error) errorCode {
+	switch {
+	case errors.Is(err, db.InvalidState):
+		return errorInvalidState
+	case errors.Is(err, db.MissingVersion):
+		return errorMissingVersion
+	case errors.Is(err, db.StateTooLarge):
+		return errorStateTooLarge
+	case errors.Is(err, db.PatchConflict):
+		return errorPatchConflict
+	case errors.Is(err, db.InvalidPatch), errors.Is(err, jsonpatch.InvalidPatch):
+		return errorInvalidPatch
+	case errors.Is(err, timer.UnknownAction):
+		return errorUnknownAction
+	case errors.Is(err, timer.InvalidTransition):
+		return errorInvalidTransition
+	case errors.Is(err, implausibleTime):
+		return errorImplausibleTime
+	case errors.Is(err, db.Forbidden), errors.Is(err, db.NoSuchRoom):
+		return errorForbidden
+	default:
+		return errorInternal
+	}
+}
+
+type helloPayload struct {
+	Protocol string `json:"protocol"`
+}
+
+// clientHelloPayload is what a client may send in its hello. Revision is the
+// last revision it has seen, if any. Delta asks for patches instead of full
+// states whenever the server has them.
+type clientHelloPayload struct {
+	Revision *db.Revision `json:"revision"`
+	Delta    bool         `json:"delta"`
+}
+
+type resumePayload struct {
+	Resume   resumeStatus `json:"resume"`
+	Revision db.Revision  `json:"revision"`
+}
+
+type ackPayload struct {
+	Push     bool        `json:"push"`
+	Revision db.Revision `json:"revision"`
+}
+
+// actionPayload is a timer action. At is when it happened on the client, in
+// milliseconds since the Unix epoch; the server time is used if it's missing.
+type actionPayload struct {
+	Action timer.Action `json:"action"`
+	At     int64        `json:"at"`
+}
+
+type errorPayload struct {
+	Code    errorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+type noticePayload struct {
+	Message string `json:"message"`
+}
+
+func newEnvelope(messageType messageType, id string, payload any) (envelope, error) {
+	message := envelope{Type: messageType, ID: id}
+	if payload == nil {
+		return message, nil
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return envelope{}, err
+	}
+	message.Payload = payloadBytes
+
+	return message, nil
+}
+
+// versionedPatch turns the patch a client sent into the one that leads to the
+// stored state, which also carries the new version and field timestamps.
+func versionedPatch(patch jsonpatch.Patch, stateString string, revision db.Revision) (json.RawMessage, error) {
+	version, err := json.Marshal(db.VersionOf(revision))
+	if err != nil {
+		return nil, err
+	}
+
+	var state struct {
+		Clocks json.RawMessage `json:"hlc"`
+	}
+	if err := json.Unmarshal([]byte(stateString), &state); err != nil {
+		return nil, err
+	}
+
+	patch = append(patch[:len(patch):len(patch)], jsonpatch.Operation{Op: "add", Path: "/version", Value: version})
+	if state.Clocks != nil {
+		patch = append(patch, jsonpatch.Operation{Op: "add", Path: "/hlc", Value: state.Clocks})
+	}
+	return json.Marshal(patch)
+}
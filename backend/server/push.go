@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"flowey/db"
+	"flowey/jobs"
+	"flowey/timer"
+	"flowey/webpush"
+)
+
+const (
+	// pushGracePeriod is how late a timer may be noticed and still be
+	// announced, for example after the server was down when it finished.
+	pushGracePeriod = 15 * time.Minute
+	// pushTTL is how long push services keep a message for an offline
+	// browser.
+	pushTTL = time.Hour
+)
+
+func writePushError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.NoSuchPushSubscription):
+		http.Error(writer, err.Error(), http.StatusNotFound)
+	case errors.Is(err, webpush.InvalidSubscription):
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, db.NoVAPIDKeys):
+		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// pushPayload is the push message of a finished timer.
+type pushPayload struct {
+	Event      string      `json:"event"`
+	Timer      string      `json:"timer"`
+	OccurredAt time.Time   `json:"occurredAt"`
+	State      timer.Timer `json:"state"`
+}
+
+// pusher sends the browsers of a user a message when one of its timers
+// finishes. It handles the db.PushFinishedJob jobs that state writes queue.
+type pusher struct {
+	client *http.Client
+}
+
+func newPusher(config Config) *pusher {
+	client := config.PushClient
+	if client == nil {
+		client = publicClient(config.PushTimeout, config.AllowLoopback)
+	}
+	return &pusher{client: client}
+}
+
+// sendFinished announces the timer of a job, unless it was written again
+// since or the job runs more than pushGracePeriod late, for example because
+// the server was down when the timer finished.
+func (pusher *pusher) sendFinished(ctx context.Context, job db.Job, now time.Time) error {
+	var payload db.PushFinishedPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return jobs.Permanent(err)
+	}
+
+	finished, ok, err := db.FinishedTimer(payload)
+	if err != nil || !ok {
+		return err
+	}
+
+	if now.Sub(finished.FinishesAt) <= pushGracePeriod {
+		pusher.notify(ctx, finished)
+	}
+	return db.MarkPushNotified(finished.Key, finished.Revision, now)
+}
+
+// notify sends a finished timer to every browser of its user. Messages that
+// fail aren't retried, and subscriptions the push service has forgotten are
+// deleted.
+func (pusher *pusher) notify(ctx context.Context, finished db.FinishingTimer) {
+	vapid, err := db.GetVAPID()
+	if err != nil {
+		if !errors.Is(err, db.NoVAPIDKeys) {
+			log.Println(err)
+		}
+		return
+	}
+
+	subscriptions, err := db.PushTargets(finished.Key.UserID)
+	if err != nil {
+		return
+	}
+
+	payload, err := json.Marshal(pushPayload{
+		Event:      "finished",
+		Timer:      finished.Timer,
+		OccurredAt: finished.FinishesAt,
+		State:      finished.State,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	message := webpush.Message{
+		Payload: payload,
+		TTL:     pushTTL,
+		Urgency: "high",
+		Topic:   fmt.Sprintf("timer-%d", finished.Key.TimerID),
+	}
+	for _, subscription := range subscriptions {
+		err := vapid.Send(ctx, pusher.client, subscription, message)
+		switch {
+		case errors.Is(err, webpush.Gone):
+			db.ForgetPushEndpoint(subscription.Endpoint)
+		case err != nil:
+			log.Printf("failed to send a push message: %v", err)
+		}
+	}
+}
+
+// pushKeyHandler gives browsers the applicationServerKey to subscribe with.
+type pushKeyHandler struct{}
+
+func (handler *pushKeyHandler) handleGet(writer http.ResponseWriter, _ *http.Request) {
+	vapid, err := db.GetVAPID()
+	if err != nil {
+		writePushError(writer, err)
+		return
+	}
+
+	publicKey, err := webpush.PublicKey(vapid.PrivateKey)
+	if err != nil {
+		log.Println(err)
+		writePushError(writer, db.InternalServerError)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, map[string]string{"publicKey": publicKey})
+}
+
+func (handler *pushKeyHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *pushKeyHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// pushSubscriptionsHandler lists and stores the push subscriptions of the
+// authenticated user's devices.
+type pushSubscriptionsHandler struct{}
+
+func (handler *pushSubscriptionsHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	subscriptions, err := db.ListPushSubscriptions(userID)
+	if err != nil {
+		writePushError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, subscriptions)
+}
+
+func (handler *pushSubscriptionsHandler) handlePost(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		webpush.Subscription
+		Device string `json:"device"`
+	}
+	if !readJSON(writer, request, &payload) {
+		return
+	}
+
+	device := strings.TrimSpace(payload.Device)
+	if !validDeviceField(device, maxDeviceNameLength) {
+		http.Error(writer, fmt.Sprintf("the device name must be at most %d bytes of printable text", maxDeviceNameLength), http.StatusBadRequest)
+		return
+	}
+
+	subscription, err := db.SavePushSubscription(userID, device, payload.Subscription)
+	if err != nil {
+		writePushError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusCreated, subscription)
+}
+
+func (handler *pushSubscriptionsHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *pushSubscriptionsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodPost:
+		handler.handlePost(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// pushSubscriptionHandler deletes a push subscription.
+type pushSubscriptionHandler struct{}
+
+func (handler *pushSubscriptionHandler) handleDelete(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	subscriptionID, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(writer, "couldn't parse the subscription id", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DeletePushSubscription(userID, subscriptionID); err != nil {
+		writePushError(writer, err)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *pushSubscriptionHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *pushSubscriptionHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodDelete:
+		handler.handleDelete(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
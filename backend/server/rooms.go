@@ -0,0 +1,338 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"flowey/db"
+)
+
+func writeRoomError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.NoSuchRoom), errors.Is(err, db.NoSuchUser),
+		errors.Is(err, db.NoSuchMember), errors.Is(err, db.NoSuchTimer):
+		http.Error(writer, err.Error(), http.StatusNotFound)
+	case errors.Is(err, db.InvalidRoomName), errors.Is(err, db.InvalidRoomRole):
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, db.RoomExists):
+		http.Error(writer, err.Error(), http.StatusConflict)
+	case errors.Is(err, db.Forbidden):
+		http.Error(writer, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// minBodyLimit is the body size always accepted, so that small state limits
+// don't get in the way of other requests.
+const minBodyLimit = 16 << 10
+
+// readBody reads a request body of at most the state size limit, answering 413
+// without reading the rest if it's larger.
+func readBody(writer http.ResponseWriter, request *http.Request) ([]byte, bool) {
+	limit := max(db.MaxStateSize(), minBodyLimit)
+	body, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, int64(limit)))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			http.Error(writer, fmt.Sprintf("the body is larger than %d bytes", limit), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(writer, "failed to read the request body", http.StatusBadRequest)
+		}
+		return nil, false
+	}
+
+	return body, true
+}
+
+func readJSON(writer http.ResponseWriter, request *http.Request, value any) bool {
+	body, ok := readBody(writer, request)
+	if !ok {
+		return false
+	}
+
+	if err := json.Unmarshal(body, value); err != nil {
+		http.Error(writer, "couldn't parse the body as a JSON object", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func pathRoomID(writer http.ResponseWriter, request *http.Request) (db.RoomID, bool) {
+	roomID, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(writer, "couldn't parse the room id", http.StatusBadRequest)
+		return 0, false
+	}
+
+	return roomID, true
+}
+
+// roomsHandler lists the rooms of the authenticated user and creates new ones.
+type roomsHandler struct{}
+
+func (handler *roomsHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	rooms, err := db.ListRooms(userID)
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, rooms)
+}
+
+func (handler *roomsHandler) handlePost(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Name  string `json:"name"`
+		Timer string `json:"timer"`
+	}
+	if !readJSON(writer, request, &payload) {
+		return
+	}
+	if payload.Timer == "" {
+		payload.Timer = db.DefaultTimerName
+	}
+
+	room, err := db.CreateRoom(userID, payload.Name, payload.Timer)
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusCreated, room)
+}
+
+func (handler *roomsHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *roomsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodPost:
+		handler.handlePost(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// roomHandler reads and deletes a single room.
+type roomHandler struct {
+	hubs *hubs
+}
+
+func (handler *roomHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	roomID, ok := pathRoomID(writer, request)
+	if !ok {
+		return
+	}
+
+	room, err := db.GetRoom(userID, roomID)
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, room)
+}
+
+func (handler *roomHandler) handleDelete(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	roomID, ok := pathRoomID(writer, request)
+	if !ok {
+		return
+	}
+
+	room, err := db.DeleteRoom(userID, roomID)
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+	handler.hubs.kick(room.Key(), func(subscription subscription) bool {
+		return subscription.room == room.ID
+	}, "room deleted")
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *roomHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, DELETE, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *roomHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodDelete:
+		handler.handleDelete(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// roomMembersHandler lists the members of a room.
+type roomMembersHandler struct{}
+
+func (handler *roomMembersHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	roomID, ok := pathRoomID(writer, request)
+	if !ok {
+		return
+	}
+
+	members, err := db.RoomMembers(userID, roomID)
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, members)
+}
+
+func (handler *roomMembersHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *roomMembersHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// roomMemberHandler adds a member to a room, changes its role or removes it.
+type roomMemberHandler struct {
+	hubs *hubs
+}
+
+func (handler *roomMemberHandler) handlePut(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	roomID, ok := pathRoomID(writer, request)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Role string `json:"role"`
+	}
+	if !readJSON(writer, request, &payload) {
+		return
+	}
+
+	role, err := db.ParseRoomRole(payload.Role)
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+
+	member, err := db.SetRoomMember(userID, roomID, request.PathValue("username"), role)
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, member)
+}
+
+func (handler *roomMemberHandler) handleDelete(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	roomID, ok := pathRoomID(writer, request)
+	if !ok {
+		return
+	}
+
+	room, err := db.GetRoom(userID, roomID)
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+
+	member, err := db.RemoveRoomMember(userID, roomID, request.PathValue("username"))
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+	handler.hubs.kick(room.Key(), func(subscription subscription) bool {
+		return subscription.room == room.ID && subscription.userID == member.UserID
+	}, "removed from the room")
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *roomMemberHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	writer.Header().Set("Access-Control-Allow-Methods", "PUT, DELETE, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *roomMemberHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodPut:
+		handler.handlePut(writer, request)
+	case http.MethodDelete:
+		handler.handleDelete(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -9,16 +9,47 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+
+	"flowey/jobs"
 )
 
+type Config struct {
+	PingInterval     time.Duration
+	PongTimeout      time.Duration
+	IdleTimeout      time.Duration
+	QueueSize        int
+	SlowClientPolicy SlowClientPolicy
+	JournalSize      int
+	MaxClockError    time.Duration
+	// SessionCheckInterval is how often the sessions of open connections
+	// are checked for having ended in another process.
+	SessionCheckInterval time.Duration
+	WebhookTimeout       time.Duration
+	PushTimeout          time.Duration
+	// AllowLoopback lets webhook deliveries and push messages reach loopback
+	// addresses, for development.
+	AllowLoopback bool
+	// CredentialedOrigins may make requests with the session cookie.
+	CredentialedOrigins []string
+	// WebhookClient sends webhook deliveries instead of a client with
+	// WebhookTimeout, if it's set.
+	WebhookClient *http.Client
+	// PushClient sends push messages instead of a client with PushTimeout,
+	// if it's set.
+	PushClient *http.Client
+	// Clock drives the job runner instead of the system clock, if it's set.
+	Clock jobs.Clock
+}
+
 type Server struct {
 	http.Server
 }
 
-func NewServer(ip string, port int) *Server {
+func NewServer(ip string, port int, config Config) *Server {
 	var server Server
 	server.Addr = fmt.Sprintf("%s:%d", ip, port)
-	server.Handler = NewServeMux()
+	server.Handler = NewServeMux(config)
 	return &server
 }
 
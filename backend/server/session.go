@@ -1,31 +1,49 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
-	"io"
+	"errors"
+	"net"
 	"net/http"
-	"strings"
+	"time"
 
 	"flowey/db"
 )
 
-type sessionHandler struct{}
+// sessionHandler logs in and out. With all set, it serves /session/all, which
+// logs out every session of the user.
+type sessionHandler struct {
+	hubs *hubs
+	all  bool
+}
 
-func (handler *sessionHandler) handlePost(writer http.ResponseWriter, request *http.Request) {
-	body, err := io.ReadAll(request.Body)
+// clientIP is the address a request came from, without the port.
+func clientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
 	if err != nil {
-		http.Error(writer, "failed to read the request body", http.StatusBadRequest)
+		return request.RemoteAddr
+	}
+	return host
+}
+
+func (handler *sessionHandler) handlePost(writer http.ResponseWriter, request *http.Request) {
+	body, ok := readBody(writer, request)
+	if !ok {
 		return
 	}
 
-	var credentials db.Credentials
-	err = json.Unmarshal(body, &credentials)
+	var login struct {
+		db.Credentials
+		Label string `json:"label"`
+	}
+	err := json.Unmarshal(body, &login)
 	if err != nil {
 		http.Error(writer, "couldn't parse the body as a JSON object", http.StatusBadRequest)
 		return
 	}
 
-	userID, err := db.AuthenticateByCredentials(credentials)
+	userID, err := db.AuthenticateByCredentials(login.Credentials)
 	if err == db.Unathorized {
 		http.Error(writer, err.Error(), http.StatusUnauthorized)
 		return
@@ -34,12 +52,18 @@ func (handler *sessionHandler) handlePost(writer http.ResponseWriter, request *h
 		return
 	}
 
-	sessionToken, err := db.CreateSessionToken(userID)
+	sessionToken, err := db.CreateSessionToken(userID, db.SessionInfo{
+		Label:     login.Label,
+		UserAgent: request.UserAgent(),
+		IP:        clientIP(request),
+	})
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	setSessionCookie(writer, sessionToken)
+
 	type loginResponse struct {
 		SessionToken string `json:"sessionToken"`
 	}
@@ -48,39 +72,143 @@ func (handler *sessionHandler) handlePost(writer http.ResponseWriter, request *h
 }
 
 func (handler *sessionHandler) handleDelete(writer http.ResponseWriter, request *http.Request) {
-	authHeader := request.Header.Get("Authorization")
-	if authHeader == "" {
+	sessionToken, ok := requestToken(request)
+	if !ok {
 		writer.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		writer.WriteHeader(http.StatusUnauthorized)
+	db.DeleteSessionToken(sessionToken)
+	clearSessionCookie(writer)
+	handler.hubs.revoke(func(subscription subscription) bool {
+		return subscription.session == sessionToken
+	}, "logged out")
+
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *sessionHandler) handleDeleteAll(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticateWithCookie(writer, request)
+	if !ok {
 		return
 	}
 
-	sessionToken := parts[1]
-	db.DeleteSessionToken(sessionToken)
+	if err := db.DeleteUserSessions(userID); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	clearSessionCookie(writer)
+	handler.hubs.revoke(func(subscription subscription) bool {
+		return subscription.userID == userID && subscription.session != ""
+	}, "logged out everywhere")
 
 	writer.WriteHeader(http.StatusOK)
 }
 
 func (handler *sessionHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
 	writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-	writer.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	if handler.all {
+		writer.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	} else {
+		writer.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	}
 	writer.WriteHeader(http.StatusOK)
 }
 
 func (handler *sessionHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	if origin := request.Header.Get("Origin"); origin != "" {
-		writer.Header().Set("Access-Control-Allow-Origin", origin)
+	allowOrigin(writer, request)
+
+	switch {
+	case request.Method == http.MethodPost && !handler.all:
+		handler.handlePost(writer, request)
+	case request.Method == http.MethodDelete && handler.all:
+		handler.handleDeleteAll(writer, request)
+	case request.Method == http.MethodDelete:
+		handler.handleDelete(writer, request)
+	case request.Method == http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// sessionsHandler lists the sessions of the authenticated user.
+type sessionsHandler struct{}
+
+func (handler *sessionsHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticateWithCookie(writer, request)
+	if !ok {
+		return
+	}
+	sessionToken, _ := requestToken(request)
+
+	sessions, err := db.ListSessions(userID, sessionToken)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, sessions)
+}
+
+func (handler *sessionsHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *sessionsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// sessionByIDHandler revokes a session of the authenticated user by its ID
+// and closes its connections.
+type sessionByIDHandler struct {
+	hubs *hubs
+}
+
+func (handler *sessionByIDHandler) handleDelete(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticateWithCookie(writer, request)
+	if !ok {
+		return
 	}
-	writer.Header().Set("Vary", "Origin")
+
+	sessionToken, err := db.RevokeSession(userID, request.PathValue("id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, db.NoSuchSession):
+			http.Error(writer, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	handler.hubs.revoke(func(subscription subscription) bool {
+		return subscription.session == sessionToken
+	}, "session revoked")
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *sessionByIDHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *sessionByIDHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
 
 	switch request.Method {
-	case http.MethodPost:
-		handler.handlePost(writer, request)
 	case http.MethodDelete:
 		handler.handleDelete(writer, request)
 	case http.MethodOptions:
@@ -89,3 +217,53 @@ func (handler *sessionHandler) ServeHTTP(writer http.ResponseWriter, request *ht
 		writer.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
+
+// sessionWatcher closes the connections of sessions that ended in another
+// process, such as flowey db passwd, every config.SessionCheckInterval.
+type sessionWatcher struct {
+	hubs     *hubs
+	interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func newSessionWatcher(hubs *hubs, config Config) *sessionWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &sessionWatcher{
+		hubs:     hubs,
+		interval: config.SessionCheckInterval,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+}
+
+func (watcher *sessionWatcher) run() {
+	defer close(watcher.done)
+
+	ticker := time.NewTicker(watcher.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-watcher.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, session := range watcher.hubs.sessions() {
+			if _, err := db.AuthenticateBySessionToken(session); err != db.Unathorized {
+				continue
+			}
+			watcher.hubs.revoke(func(subscription subscription) bool {
+				return subscription.session == session
+			}, "session revoked")
+		}
+	}
+}
+
+func (watcher *sessionWatcher) close() {
+	watcher.cancel()
+	<-watcher.done
+}
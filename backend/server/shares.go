@@ -0,0 +1,179 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"flowey/db"
+)
+
+func writeShareError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.NoSuchShare), errors.Is(err, db.NoSuchTimer):
+		http.Error(writer, err.Error(), http.StatusNotFound)
+	case errors.Is(err, db.InvalidShare):
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// sharesHandler lists and mints the spectator share tokens of the
+// authenticated user.
+type sharesHandler struct{}
+
+func (handler *sharesHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	shares, err := db.ListShares(userID)
+	if err != nil {
+		writeShareError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, shares)
+}
+
+func (handler *sharesHandler) handlePost(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Timer     string     `json:"timer"`
+		Label     string     `json:"label"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+	if !readJSON(writer, request, &payload) {
+		return
+	}
+	if payload.Timer == "" {
+		payload.Timer = db.DefaultTimerName
+	}
+
+	share, err := db.CreateShare(userID, payload.Timer, payload.Label, payload.ExpiresAt)
+	if err != nil {
+		writeShareError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusCreated, share)
+}
+
+func (handler *sharesHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *sharesHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodPost:
+		handler.handlePost(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// shareHandler revokes a share token and disconnects its spectators.
+type shareHandler struct {
+	hubs *hubs
+}
+
+func (handler *shareHandler) handleDelete(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	shareID, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(writer, "couldn't parse the share id", http.StatusBadRequest)
+		return
+	}
+
+	share, err := db.RevokeShare(userID, shareID)
+	if err != nil {
+		writeShareError(writer, err)
+		return
+	}
+	handler.hubs.kick(share.Key(), func(subscription subscription) bool {
+		return subscription.share == share.ID
+	}, "share revoked")
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *shareHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *shareHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodDelete:
+		handler.handleDelete(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// spectatorHandler streams a shared timer to anyone holding the token, over a
+// websocket if the request is an upgrade and as server-sent events otherwise.
+// Spectators join the same hub as the owner's connections, but every write
+// they send is rejected.
+type spectatorHandler struct {
+	ws     *wsHandler
+	events *eventsHandler
+}
+
+func (handler *spectatorHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	share, err := db.ShareByToken(request.PathValue("token"))
+	if err != nil {
+		writeShareError(writer, err)
+		return
+	}
+
+	subscription := subscription{key: share.Key(), timer: share.Timer, share: share.ID}
+	if share.ExpiresAt != nil {
+		subscription.expiresAt = *share.ExpiresAt
+	}
+
+	device, err := requestDevice(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !strings.EqualFold(request.Header.Get("Upgrade"), "websocket") {
+		handler.events.stream(writer, request, subscription, device)
+		return
+	}
+
+	handler.ws.waitGroup.Add(1)
+
+	if err := handler.ws.handle(subscription, device, writer, request); err != nil {
+		log.Println(err)
+	}
+}
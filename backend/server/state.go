@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"flowey/db"
+)
+
+type stateHandler struct {
+	hubs *hubs
+}
+
+func etag(revision db.Revision) string {
+	return fmt.Sprintf("%q", strconv.FormatInt(revision, 10))
+}
+
+func parseETag(header string) (db.Revision, bool) {
+	unquoted, err := strconv.Unquote(strings.TrimPrefix(header, "W/"))
+	if err != nil {
+		return 0, false
+	}
+
+	revision, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return revision, true
+}
+
+func writeState(writer http.ResponseWriter, status int, stateString string, revision db.Revision) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("ETag", etag(revision))
+	writer.WriteHeader(status)
+	io.WriteString(writer, stateString)
+}
+
+func (handler *stateHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	subscription, ok := requestSubscription(writer, request, userID)
+	if !ok {
+		return
+	}
+
+	stateString, revision, err := db.GetStateRevision(subscription.key)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if stateString == "" {
+		writer.Header().Set("ETag", etag(revision))
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeState(writer, http.StatusOK, stateString, revision)
+}
+
+func (handler *stateHandler) handlePut(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	subscription, ok := requestSubscription(writer, request, userID)
+	if !ok {
+		return
+	}
+
+	ifMatch := request.Header.Get("If-Match")
+	if ifMatch == "" {
+		http.Error(writer, "the If-Match header is required", http.StatusPreconditionRequired)
+		return
+	}
+
+	revision, ok := parseETag(ifMatch)
+	if !ok {
+		http.Error(writer, "couldn't parse the If-Match header", http.StatusBadRequest)
+		return
+	}
+
+	body, ok := readBody(writer, request)
+	if !ok {
+		return
+	}
+
+	origin := requestOrigin("http", request)
+	applied, update, err := handler.hubs.submit(subscription.key, subscription.control(func() (bool, stateUpdate, error) {
+		applied, stateString, revision, err := db.ReplaceState(subscription.key, origin, revision, string(body))
+		return applied, stateUpdate{stateString: stateString, revision: revision}, err
+	}))
+	if err != nil {
+		switch {
+		case errors.Is(err, db.Forbidden):
+			http.Error(writer, err.Error(), http.StatusForbidden)
+		case errors.Is(err, db.NoSuchRoom):
+			http.Error(writer, err.Error(), http.StatusNotFound)
+		case errors.Is(err, db.InvalidState), errors.Is(err, db.MissingVersion):
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, db.StateTooLarge):
+			http.Error(writer, err.Error(), http.StatusRequestEntityTooLarge)
+		default:
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !applied {
+		writeState(writer, http.StatusPreconditionFailed, update.stateString, update.revision)
+		return
+	}
+
+	writeState(writer, http.StatusOK, update.stateString, update.revision)
+}
+
+func (handler *stateHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+	writer.Header().Set("Access-Control-Expose-Headers", "ETag")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *stateHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodPut:
+		handler.handlePut(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
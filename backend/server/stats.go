@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	_ "time/tzdata"
+
+	"flowey/db"
+)
+
+const (
+	dateLayout       = "2006-01-02"
+	defaultStatsDays = 30
+)
+
+// parseDate parses a date of the form YYYY-MM-DD at midnight in the
+// location, or returns fallback if there is none.
+func parseDate(value string, location *time.Location, fallback time.Time) (time.Time, bool) {
+	if value == "" {
+		return fallback, true
+	}
+	date, err := time.ParseInLocation(dateLayout, value, location)
+	return date, err == nil
+}
+
+// statsHandler sums up the focus runs of the authenticated user by day, week
+// and month in the user's timezone.
+type statsHandler struct{}
+
+func (handler *statsHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	query := request.URL.Query()
+
+	location := time.UTC
+	if name := query.Get("tz"); name != "" {
+		var err error
+		location, err = time.LoadLocation(name)
+		if err != nil {
+			http.Error(writer, "couldn't parse the timezone", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	today := now.In(location)
+	to, ok := parseDate(query.Get("to"), location, today)
+	if !ok {
+		http.Error(writer, "couldn't parse the end date", http.StatusBadRequest)
+		return
+	}
+	from, ok := parseDate(query.Get("from"), location, to.AddDate(0, 0, 1-defaultStatsDays))
+	if !ok {
+		http.Error(writer, "couldn't parse the start date", http.StatusBadRequest)
+		return
+	}
+
+	timerName := query.Get("timer")
+	if timerName != "" {
+		if _, err := db.GetTimer(userID, timerName); err != nil {
+			writeTimerError(writer, err)
+			return
+		}
+	}
+
+	stats, err := db.Stats(userID, timerName, location, from, to, now)
+	if errors.Is(err, db.InvalidRange) {
+		http.Error(writer, fmt.Sprintf("the range must span 1 to %d days", db.MaxStatsDays), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, stats)
+}
+
+func (handler *statsHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *statsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
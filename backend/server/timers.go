@@ -0,0 +1,219 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"flowey/db"
+)
+
+// requestSubscription resolves the timer named by the timer query parameter,
+// the shared timer of the room named by the room query parameter, or the
+// default timer if there is neither.
+func requestSubscription(writer http.ResponseWriter, request *http.Request, userID db.UserID) (subscription, bool) {
+	query := request.URL.Query()
+	if query.Has("room") {
+		if query.Has("timer") {
+			http.Error(writer, "a request can't name both a timer and a room", http.StatusBadRequest)
+			return subscription{}, false
+		}
+
+		roomID, err := strconv.ParseInt(query.Get("room"), 10, 64)
+		if err != nil {
+			http.Error(writer, "couldn't parse the room id", http.StatusBadRequest)
+			return subscription{}, false
+		}
+
+		room, err := db.GetRoom(userID, roomID)
+		if err != nil {
+			writeRoomError(writer, err)
+			return subscription{}, false
+		}
+
+		return subscription{key: room.Key(), userID: userID, timer: room.Timer, room: room.ID}, true
+	}
+
+	name := query.Get("timer")
+	if name == "" {
+		name = db.DefaultTimerName
+	}
+
+	timer, err := db.GetTimer(userID, name)
+	if err != nil {
+		writeTimerError(writer, err)
+		return subscription{}, false
+	}
+
+	return subscription{key: timer.Key(), userID: userID, timer: timer.Name}, true
+}
+
+func writeTimerError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.NoSuchTimer):
+		http.Error(writer, err.Error(), http.StatusNotFound)
+	case errors.Is(err, db.InvalidTimerName):
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, db.TimerExists), errors.Is(err, db.DefaultTimer):
+		http.Error(writer, err.Error(), http.StatusConflict)
+	default:
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func readTimerName(writer http.ResponseWriter, request *http.Request) (string, bool) {
+	var payload struct {
+		Name string `json:"name"`
+	}
+	if !readJSON(writer, request, &payload) {
+		return "", false
+	}
+
+	return payload.Name, true
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(value)
+}
+
+// timersHandler lists and creates the timers of the authenticated user.
+type timersHandler struct{}
+
+func (handler *timersHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	timers, err := db.ListTimers(userID)
+	if err != nil {
+		writeTimerError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, timers)
+}
+
+func (handler *timersHandler) handlePost(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	name, ok := readTimerName(writer, request)
+	if !ok {
+		return
+	}
+
+	timer, err := db.CreateTimer(userID, name)
+	if err != nil {
+		writeTimerError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusCreated, timer)
+}
+
+func (handler *timersHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *timersHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodPost:
+		handler.handlePost(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// timerHandler reads, renames and deletes a single timer, named by the last
+// segment of the path.
+type timerHandler struct {
+	hubs *hubs
+}
+
+func (handler *timerHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	timer, err := db.GetTimer(userID, request.PathValue("name"))
+	if err != nil {
+		writeTimerError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, timer)
+}
+
+func (handler *timerHandler) handlePatch(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	name, ok := readTimerName(writer, request)
+	if !ok {
+		return
+	}
+
+	timer, err := db.RenameTimer(userID, request.PathValue("name"), name)
+	if err != nil {
+		writeTimerError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, timer)
+}
+
+func (handler *timerHandler) handleDelete(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	timer, err := db.DeleteTimer(userID, request.PathValue("name"))
+	if err != nil {
+		writeTimerError(writer, err)
+		return
+	}
+	handler.hubs.forget(timer.Key())
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *timerHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, PATCH, DELETE, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *timerHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodPatch:
+		handler.handlePatch(writer, request)
+	case http.MethodDelete:
+		handler.handleDelete(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"flowey/db"
+)
+
+const (
+	// webhookBatchSize is how many due deliveries are read at a time.
+	webhookBatchSize = 16
+	// webhookIdleInterval is how long the sender waits at most before looking
+	// for due deliveries again.
+	webhookIdleInterval = time.Minute
+	// maxWebhookResponseSize is how much of a response is read before the
+	// connection is closed.
+	maxWebhookResponseSize = 64 << 10
+)
+
+func writeWebhookError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.NoSuchWebhook):
+		http.Error(writer, err.Error(), http.StatusNotFound)
+	case errors.Is(err, db.InvalidWebhook):
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func pathWebhookID(writer http.ResponseWriter, request *http.Request) (db.WebhookID, bool) {
+	webhookID, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(writer, "couldn't parse the webhook id", http.StatusBadRequest)
+		return 0, false
+	}
+	return webhookID, true
+}
+
+// signWebhook returns the signature header of a payload: the hex HMAC-SHA256
+// of the timestamp, a dot and the body, keyed with the webhook's secret. The
+// timestamp lets receivers reject replayed deliveries.
+func signWebhook(secret string, timestamp string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp+"."+payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSender posts the deliveries of the webhook outbox as they come due,
+// one at a time.
+type webhookSender struct {
+	client *http.Client
+	now    func() time.Time
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newWebhookSender(config Config) *webhookSender {
+	client := config.WebhookClient
+	if client == nil {
+		client = publicClient(config.WebhookTimeout, config.AllowLoopback)
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookSender{
+		client: client,
+		now:    time.Now,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+func (sender *webhookSender) run() {
+	defer close(sender.done)
+
+	for {
+		sender.sendDue()
+
+		wait := webhookIdleInterval
+		if at, ok, err := db.NextDeliveryAt(); err == nil && ok {
+			wait = min(max(at.Sub(sender.now()), 0), webhookIdleInterval)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-sender.ctx.Done():
+			timer.Stop()
+			return
+		case <-db.DeliveriesQueued():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (sender *webhookSender) sendDue() {
+	for sender.ctx.Err() == nil {
+		deliveries, err := db.DueDeliveries(sender.now(), webhookBatchSize)
+		if err != nil || len(deliveries) == 0 {
+			return
+		}
+
+		for _, delivery := range deliveries {
+			responseStatus, err := sender.send(delivery)
+			if sender.ctx.Err() != nil {
+				// Shutting down; the delivery stays due for the next start.
+				return
+			}
+			if err != nil {
+				log.Printf("failed to deliver webhook delivery %d: %v", delivery.ID, err)
+			}
+			if err := db.RecordDeliveryAttempt(delivery, sender.now(), responseStatus, err); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// send posts a delivery and returns the response status, if there was a
+// response. Anything but a 2xx status is an error.
+func (sender *webhookSender) send(delivery db.PendingDelivery) (int, error) {
+	request, err := http.NewRequestWithContext(sender.ctx, http.MethodPost, delivery.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "flowey-webhooks")
+	request.Header.Set("X-Flowey-Event", string(delivery.Event))
+	request.Header.Set("X-Flowey-Delivery", strconv.FormatInt(delivery.ID, 10))
+	timestamp := strconv.FormatInt(sender.now().Unix(), 10)
+	request.Header.Set("X-Flowey-Timestamp", timestamp)
+	request.Header.Set("X-Flowey-Signature", signWebhook(delivery.Secret, timestamp, delivery.Payload))
+
+	response, err := sender.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, maxWebhookResponseSize))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("the receiver answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+func (sender *webhookSender) close() {
+	sender.cancel()
+	<-sender.done
+}
+
+// webhooksHandler lists and registers the webhooks of the authenticated user.
+type webhooksHandler struct{}
+
+func (handler *webhooksHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	webhooks, err := db.ListWebhooks(userID)
+	if err != nil {
+		writeWebhookError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, webhooks)
+}
+
+func (handler *webhooksHandler) handlePost(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		URL    string            `json:"url"`
+		Events []db.WebhookEvent `json:"events"`
+	}
+	if !readJSON(writer, request, &payload) {
+		return
+	}
+
+	webhook, err := db.CreateWebhook(userID, payload.URL, payload.Events)
+	if err != nil {
+		writeWebhookError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusCreated, webhook)
+}
+
+func (handler *webhooksHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *webhooksHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodPost:
+		handler.handlePost(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookHandler shows and deletes a webhook.
+type webhookHandler struct{}
+
+func (handler *webhookHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	webhookID, ok := pathWebhookID(writer, request)
+	if !ok {
+		return
+	}
+
+	webhook, err := db.GetWebhook(userID, webhookID)
+	if err != nil {
+		writeWebhookError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, webhook)
+}
+
+func (handler *webhookHandler) handleDelete(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	webhookID, ok := pathWebhookID(writer, request)
+	if !ok {
+		return
+	}
+
+	if err := db.DeleteWebhook(userID, webhookID); err != nil {
+		writeWebhookError(writer, err)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *webhookHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, DELETE, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *webhookHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodDelete:
+		handler.handleDelete(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookDeliveriesHandler lists the delivery log of a webhook.
+type webhookDeliveriesHandler struct{}
+
+func (handler *webhookDeliveriesHandler) handleGet(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	webhookID, ok := pathWebhookID(writer, request)
+	if !ok {
+		return
+	}
+
+	deliveries, err := db.ListWebhookDeliveries(userID, webhookID)
+	if err != nil {
+		writeWebhookError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, deliveries)
+}
+
+func (handler *webhookDeliveriesHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *webhookDeliveriesHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodGet:
+		handler.handleGet(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookTestHandler queues a test event for a webhook.
+type webhookTestHandler struct{}
+
+func (handler *webhookTestHandler) handlePost(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := authenticate(writer, request)
+	if !ok {
+		return
+	}
+
+	webhookID, ok := pathWebhookID(writer, request)
+	if !ok {
+		return
+	}
+
+	delivery, err := db.TestWebhook(userID, webhookID)
+	if err != nil {
+		writeWebhookError(writer, err)
+		return
+	}
+
+	writeJSON(writer, http.StatusAccepted, delivery)
+}
+
+func (handler *webhookTestHandler) handleOptions(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (handler *webhookTestHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowOrigin(writer, request)
+
+	switch request.Method {
+	case http.MethodPost:
+		handler.handlePost(writer, request)
+	case http.MethodOptions:
+		handler.handleOptions(writer, request)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"flowey/db"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// receivedDelivery is a request a test receiver got.
+type receivedDelivery struct {
+	header http.Header
+	body   string
+}
+
+// webhookReceiver answers deliveries with its status and keeps them.
+type webhookReceiver struct {
+	*httptest.Server
+	status     int
+	deliveries []receivedDelivery
+	mutex      sync.Mutex
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+
+		receiver.mutex.Lock()
+		defer receiver.mutex.Unlock()
+		receiver.deliveries = append(receiver.deliveries, receivedDelivery{request.Header, string(body)})
+		writer.WriteHeader(receiver.status)
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+// prepareWebhook creates a user with a webhook posting to url and queues a
+// test delivery.
+func prepareWebhook(t *testing.T, url string) db.Webhook {
+	t.Helper()
+	if err := db.Prepare(filepath.Join(t.TempDir(), "flowey.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	if err := db.Add("alice", 12); err != nil {
+		t.Fatal(err)
+	}
+	// The first user of a new database.
+	userID := db.UserID(1)
+
+	webhook, err := db.CreateWebhook(userID, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.TestWebhook(userID, webhook.ID); err != nil {
+		t.Fatal(err)
+	}
+	return webhook
+}
+
+func onlyDelivery(t *testing.T, webhook db.Webhook) db.WebhookDelivery {
+	t.Helper()
+	deliveries, err := db.ListWebhookDeliveries(db.UserID(1), webhook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	webhook := prepareWebhook(t, receiver.URL+"/hook")
+
+	now := time.UnixMilli(time.Now().UnixMilli())
+	sender := newWebhookSender(Config{WebhookTimeout: time.Second, AllowLoopback: true})
+	sender.now = func() time.Time { return now }
+
+	// A failed attempt is recorded and retried after the backoff.
+	receiver.status = http.StatusInternalServerError
+	sender.sendDue()
+
+	if len(receiver.deliveries) != 1 {
+		t.Fatalf("the receiver got %d deliveries, want 1", len(receiver.deliveries))
+	}
+	received := receiver.deliveries[0]
+	timestamp := received.header.Get("X-Flowey-Timestamp")
+	if want := strconv.FormatInt(now.Unix(), 10); timestamp != want {
+		t.Errorf("got the timestamp %q, want %q", timestamp, want)
+	}
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	io.WriteString(mac, timestamp+"."+received.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); received.header.Get("X-Flowey-Signature") != want {
+		t.Errorf("got the signature %q, want %q", received.header.Get("X-Flowey-Signature"), want)
+	}
+	if event := received.header.Get("X-Flowey-Event"); event != string(db.WebhookTest) {
+		t.Errorf("got the event %q, want %q", event, db.WebhookTest)
+	}
+
+	delivery := onlyDelivery(t, webhook)
+	if delivery.Status != db.DeliveryPending || delivery.Attempts != 1 ||
+		delivery.ResponseStatus == nil || *delivery.ResponseStatus != http.StatusInternalServerError {
+		t.Fatalf("got %+v after a failed attempt", delivery)
+	}
+	retryAt := now.Add(10 * time.Second)
+	if delivery.NextAttemptAt == nil || !delivery.NextAttemptAt.Equal(retryAt) {
+		t.Fatalf("got the next attempt at %v, want %v", delivery.NextAttemptAt, retryAt)
+	}
+
+	// Nothing is sent before the retry is due.
+	now = retryAt.Add(-time.Millisecond)
+	sender.sendDue()
+	if len(receiver.deliveries) != 1 {
+		t.Fatalf("the receiver got %d deliveries before the retry, want 1", len(receiver.deliveries))
+	}
+
+	receiver.status = http.StatusNoContent
+	now = retryAt
+	sender.sendDue()
+
+	delivery = onlyDelivery(t, webhook)
+	if delivery.Status != db.DeliveryDelivered || delivery.Attempts != 2 {
+		t.Fatalf("got %+v after a successful attempt", delivery)
+	}
+}
+
+func TestWebhookLoopbackRefused(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	webhook := prepareWebhook(t, receiver.URL+"/hook")
+
+	sender := newWebhookSender(Config{WebhookTimeout: time.Second})
+	sender.sendDue()
+
+	if len(receiver.deliveries) != 0 {
+		t.Fatalf("the receiver got %d deliveries, want 0", len(receiver.deliveries))
+	}
+	delivery := onlyDelivery(t, webhook)
+	if delivery.Status != db.DeliveryPending || delivery.ResponseStatus != nil ||
+		!strings.Contains(delivery.Error, "isn't a public address") {
+		t.Fatalf("got %+v for a loopback receiver", delivery)
+	}
+}
@@ -2,133 +2,574 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coder/websocket"
 
 	"flowey/db"
+	"flowey/jsonpatch"
 )
 
+const (
+	maxMalformedFrames = 3
+	writeTimeout       = 10 * time.Second
+	// closeTimeout is how long the remaining messages and the close
+	// handshake may take before the connection is cut off.
+	closeTimeout = 2 * time.Second
+)
+
+// closeRequest asks the writer goroutine to close the connection. With notice
+// set, v2 clients are told the reason in a notice first.
+type closeRequest struct {
+	status websocket.StatusCode
+	reason string
+	notice bool
+}
+
 type connection struct {
 	*websocket.Conn
 	writer  http.ResponseWriter
 	request *http.Request
+	hub     *hub
+	outbox  *outbox
+	origin  string
+
+	malformedFrames int
+	closeRequested  atomic.Bool
+	closing         chan closeRequest
+
+	subscribed   subscription
+	device       device
+	connectedAt  time.Time
+	lastActivity atomic.Int64
+	latency      atomic.Int64
+	delta        atomic.Bool
+
+	receivedAt    time.Time
+	offset        atomic.Int64
+	offsetKnown   atomic.Bool
+	maxClockError time.Duration
 }
 
-func (connection *connection) handleFrame(ctx context.Context, userID db.UserID, connections *connections) error {
-	messageType, message, err := connection.Read(ctx)
-	if err != nil {
-		var closeError websocket.CloseError
-		if errors.As(err, &closeError) {
-			return fmt.Errorf(
-				"received a close frame from %v (%d, %q)",
-				connection.request.RemoteAddr, closeError.Code, closeError.Reason,
-			)
+func newConnection(conn *websocket.Conn, writer http.ResponseWriter, request *http.Request, hub *hub, subscribed subscription, device device, config Config) *connection {
+	connection := connection{
+		Conn:    conn,
+		writer:  writer,
+		request: request,
+		hub:     hub,
+		outbox:  newOutbox(config.QueueSize, config.SlowClientPolicy),
+		origin:  requestOrigin(conn.Subprotocol(), request),
+
+		subscribed:    subscribed,
+		device:        device,
+		maxClockError: config.MaxClockError,
+		closing:       make(chan closeRequest, 1),
+		connectedAt:   time.Now(),
+	}
+	connection.touch()
+	connection.latency.Store(-1)
+	return &connection
+}
+
+func (connection *connection) subscription() subscription {
+	return connection.subscribed
+}
+
+// touch records inbound data. Pongs don't count, so that a client that only
+// answers pings still times out.
+func (connection *connection) touch() {
+	connection.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (connection *connection) info() connectionInfo {
+	info := connectionInfo{
+		ID:           connection.device.id,
+		Device:       connection.device.name,
+		Platform:     connection.device.platform,
+		RemoteAddr:   connection.request.RemoteAddr,
+		Protocol:     connection.Subprotocol(),
+		ConnectedAt:  connection.connectedAt,
+		LastActivity: time.Unix(0, connection.lastActivity.Load()),
+		Timer:        connection.subscribed.timer,
+		Room:         connection.subscribed.room,
+	}
+
+	if latency := connection.latency.Load(); latency >= 0 {
+		milliseconds := float64(latency) / float64(time.Millisecond)
+		info.LatencyMs = &milliseconds
+	}
+
+	if offset, ok := connection.clockOffset(); ok {
+		info.ClockOffsetMs = &offset
+	}
+
+	return info
+}
+
+// keepAlive pings the client every config.PingInterval and drops the
+// connection if a pong doesn't arrive within config.PongTimeout or if nothing
+// has been received for config.IdleTimeout. It returns when ctx is done.
+func (connection *connection) keepAlive(ctx context.Context, config Config) {
+	ticker := time.NewTicker(config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 
+		idle := time.Since(time.Unix(0, connection.lastActivity.Load()))
+		if config.IdleTimeout > 0 && idle > config.IdleTimeout {
+			log.Printf("dropping an idle connection with %v (%v)", connection.request.RemoteAddr, idle.Round(time.Second))
+			connection.Close(websocket.StatusGoingAway, "idle timeout")
+			return
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, config.PongTimeout)
+		start := time.Now()
+		err := connection.Ping(pingCtx)
+		cancel()
+
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("dropping a dead connection with %v: %v", connection.request.RemoteAddr, err)
+				connection.CloseNow()
+			}
+			return
+		}
+
+		connection.latency.Store(int64(time.Since(start)))
+	}
+}
+
+func (connection *connection) enqueue(message []byte) {
+	if !connection.outbox.push(message) {
+		log.Printf("dropping a slow connection with %v", connection.request.RemoteAddr)
+		go connection.Close(websocket.StatusTryAgainLater, "outbound queue overflow")
+	}
+}
+
+func (connection *connection) send(messageType messageType, id string, payload any) error {
+	message, err := newEnvelope(messageType, id, payload)
+	if err != nil {
 		return err
 	}
 
-	if messageType != websocket.MessageText {
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	connection.enqueue(messageBytes)
+	return nil
+}
+
+func (connection *connection) sendError(id string, code errorCode, message string) error {
+	return connection.send(messageError, id, errorPayload{code, message})
+}
+
+func (connection *connection) write(ctx context.Context, message []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	return connection.Write(ctx, websocket.MessageText, message)
+}
+
+// writeLoop drains the outbox until ctx is done or a close is requested, in
+// which case it flushes the remaining messages before sending the close frame.
+// If that takes longer than closeTimeout, cancel cuts the connection off.
+func (connection *connection) writeLoop(ctx context.Context, cancel context.CancelFunc) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-connection.outbox.messages:
+			if err := connection.write(ctx, message); err != nil {
+				log.Printf("failed to write to %v: %v", connection.request.RemoteAddr, err)
+				connection.CloseNow()
+				return
+			}
+		case request := <-connection.closing:
+			connection.writeClose(ctx, cancel, request)
+			return
+		}
+	}
+}
+
+func (connection *connection) writeClose(ctx context.Context, cancel context.CancelFunc, request closeRequest) {
+	// Canceling the context of the pending read closes the connection, which
+	// also ends a close handshake the client doesn't answer.
+	timer := time.AfterFunc(closeTimeout, cancel)
+	defer timer.Stop()
+
+	ctx, cancelWrites := context.WithTimeout(ctx, closeTimeout)
+	defer cancelWrites()
+
+	if err := connection.flush(ctx); err != nil {
+		connection.CloseNow()
+		return
+	}
+
+	if request.notice && connection.Subprotocol() == protocolV2 {
+		message, err := newEnvelope(messageNotice, "", noticePayload{request.reason})
+		if err == nil {
+			messageBytes, _ := json.Marshal(message)
+			if err := connection.write(ctx, messageBytes); err != nil {
+				connection.CloseNow()
+				return
+			}
+		}
+	}
+
+	connection.Close(request.status, request.reason)
+}
+
+func (connection *connection) flush(ctx context.Context) error {
+	for {
+		select {
+		case message := <-connection.outbox.messages:
+			if err := connection.write(ctx, message); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// requestClose hands the close to the writer goroutine without blocking. Only
+// the first request counts.
+func (connection *connection) requestClose(request closeRequest) {
+	connection.closeRequested.Store(true)
+	select {
+	case connection.closing <- request:
+	default:
+	}
+}
+
+// reject reports a malformed frame to the client and closes the connection
+// once too many of them arrive in a row. Legacy clients don't understand error
+// frames, so they only get the close frame.
+func (connection *connection) reject(id string, code errorCode, message string, status websocket.StatusCode) error {
+	connection.malformedFrames++
+
+	if connection.Subprotocol() == protocolV2 {
+		if err := connection.sendError(id, code, message); err != nil {
+			return err
+		}
+	}
+
+	if connection.malformedFrames < maxMalformedFrames {
 		return nil
 	}
 
-	push, stateString, err := db.ChooseState(userID, string(message))
-	if err != nil {
+	reason := fmt.Sprintf("too many malformed frames (%s)", code)
+	connection.requestClose(closeRequest{status: status, reason: reason})
+	return fmt.Errorf("closed the connection with %v: %s", connection.request.RemoteAddr, reason)
+}
+
+func (connection *connection) rejectState(id string, err error) error {
+	code := stateErrorCode(err)
+	switch code {
+	case errorInternal:
 		log.Println("failed to choose state: ", err)
+		if connection.Subprotocol() == protocolV2 {
+			return connection.sendError(id, code, "failed to store the state")
+		}
+		return nil
+	case errorInvalidTransition, errorImplausibleTime, errorForbidden, errorPatchConflict:
+		if connection.Subprotocol() == protocolV2 {
+			return connection.sendError(id, code, err.Error())
+		}
 		return nil
 	}
 
-	if push {
-		for connection := range connections.get(userID) {
-			if err := connection.Write(ctx, websocket.MessageText, []byte(stateString)); err != nil {
-				log.Println(err)
-			}
+	return connection.reject(id, code, err.Error(), websocket.StatusInvalidFramePayloadData)
+}
+
+func (connection *connection) sendState(update stateUpdate) {
+	if connection.Subprotocol() == protocolV2 {
+		message, err := newEnvelope(messageState, "", json.RawMessage(update.stateString))
+		if connection.delta.Load() && update.patch != nil {
+			message, err = newEnvelope(messagePatch, "", update.patch)
+			base := update.revision - 1
+			message.Base = &base
+		}
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		message.Revision = &update.revision
+
+		messageBytes, err := json.Marshal(message)
+		if err != nil {
+			log.Println(err)
+			return
 		}
+
+		connection.enqueue(messageBytes)
+		return
 	}
+	connection.enqueue([]byte(update.stateString))
+}
 
-	return nil
+func (connection *connection) sendPresence(payload presencePayload) {
+	if connection.Subprotocol() != protocolV2 {
+		return
+	}
+
+	message, err := newEnvelope(messagePresence, "", payload)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	connection.enqueue(messageBytes)
 }
 
-type userConnections = map[*connection]bool
+// closeWithStatus asks the writer goroutine to send what's queued, a notice
+// and a close frame. It doesn't block, so hubs and handlers can call it.
+func (connection *connection) closeWithStatus(status websocket.StatusCode, reason string) {
+	connection.requestClose(closeRequest{status: status, reason: reason, notice: true})
+}
 
-func newUserConnections() userConnections {
-	return make(map[*connection]bool)
+func (connection *connection) close(reason string) {
+	connection.closeWithStatus(websocket.StatusNormalClosure, reason)
 }
 
-type connections struct {
-	dict  map[db.UserID]userConnections
-	mutex sync.RWMutex
+func (connection *connection) revoke(reason string) {
+	connection.closeWithStatus(websocket.StatusPolicyViolation, reason)
 }
 
-func newConnections() connections {
-	return connections{dict: make(map[db.UserID]userConnections)}
+func (connection *connection) handleState(stateString string) (push bool, revision db.Revision, err error) {
+	if err := connection.checkState(stateString); err != nil {
+		return false, 0, err
+	}
+
+	push, update, err := connection.hub.submit(chooseState(connection.subscribed, connection.origin, stateString))
+	if err == nil && !push && update.stateString != "" {
+		connection.sendState(update)
+	}
+	return push, update.revision, err
 }
 
-func (connections *connections) get(userID db.UserID) userConnections {
-	connections.mutex.RLock()
-	defer connections.mutex.RUnlock()
+// handlePatch applies a client patch on top of its base revision. If the base
+// is stale, the sender alone gets the current state to rebase on.
+func (connection *connection) handlePatch(message envelope) error {
+	if message.Base == nil {
+		return connection.reject(
+			message.ID, errorInvalidMessage,
+			"a patch needs a base revision",
+			websocket.StatusInvalidFramePayloadData,
+		)
+	}
+	base := *message.Base
 
-	userConnections, ok := connections.dict[userID]
-	if !ok {
-		return nil
+	patch, err := jsonpatch.Parse(message.Payload)
+	if err != nil {
+		return connection.rejectState(message.ID, err)
+	}
+
+	if err := connection.checkPatch(patch); err != nil {
+		return connection.rejectState(message.ID, err)
 	}
 
-	return userConnections
+	applied, update, err := connection.hub.submit(connection.subscribed.control(func() (bool, stateUpdate, error) {
+		applied, stateString, revision, err := db.PatchState(connection.subscribed.key, connection.origin, base, patch)
+		update := stateUpdate{stateString: stateString, revision: revision}
+		if errors.Is(err, db.PatchConflict) && stateString != "" {
+			connection.sendState(update)
+		}
+		if err != nil {
+			return false, stateUpdate{}, err
+		}
+
+		if !applied {
+			if stateString != "" {
+				connection.sendState(update)
+			}
+			return false, update, nil
+		}
+
+		update.patch, err = versionedPatch(patch, stateString, revision)
+		if err != nil {
+			log.Println("failed to encode a patch: ", err)
+		}
+		return true, update, nil
+	}))
+	if err != nil {
+		return connection.rejectState(message.ID, err)
+	}
+	connection.malformedFrames = 0
+
+	return connection.send(messageAck, message.ID, ackPayload{applied, update.revision})
 }
 
-func (connections *connections) store(userID db.UserID, connection *connection) {
-	connections.mutex.Lock()
-	defer connections.mutex.Unlock()
+func (connection *connection) handleAction(message envelope) error {
+	var payload actionPayload
+	if err := json.Unmarshal(message.Payload, &payload); err != nil {
+		return connection.reject(
+			message.ID, errorInvalidMessage,
+			"couldn't parse the action payload",
+			websocket.StatusInvalidFramePayloadData,
+		)
+	}
 
-	if userConnections, ok := connections.dict[userID]; ok {
-		userConnections[connection] = true
-		return
+	offset, _ := connection.clockOffset()
+	at, err := checkActionTime(payload.At, offset, connection.maxClockError)
+	if err != nil {
+		return connection.rejectState(message.ID, err)
 	}
+	payload.At = at
 
-	userConnections := newUserConnections()
-	userConnections[connection] = true
-	connections.dict[userID] = userConnections
+	push, update, err := connection.hub.submit(applyAction(connection.subscribed, connection.origin, payload))
+	if err != nil {
+		return connection.rejectState(message.ID, err)
+	}
+	connection.malformedFrames = 0
+
+	return connection.send(messageAck, message.ID, ackPayload{push, update.revision})
 }
 
-func (connections *connections) delete(userID db.UserID, connection *connection) {
-	connections.mutex.Lock()
-	defer connections.mutex.Unlock()
+func (connection *connection) handleHello(message envelope) error {
+	var payload clientHelloPayload
+	if len(message.Payload) > 0 {
+		if err := json.Unmarshal(message.Payload, &payload); err != nil {
+			return connection.reject(
+				message.ID, errorInvalidMessage,
+				"couldn't parse the hello payload",
+				websocket.StatusInvalidFramePayloadData,
+			)
+		}
+	}
+	connection.malformedFrames = 0
+	connection.delta.Store(payload.Delta)
 
-	if userConnections, ok := connections.dict[userID]; ok {
-		delete(userConnections, connection)
+	if payload.Revision == nil {
+		return connection.send(messageAck, message.ID, nil)
 	}
+
+	var status resumeStatus
+	var current db.Revision
+	_, _, err := connection.hub.submit(func() (bool, stateUpdate, error) {
+		var err error
+		status, current, err = connection.hub.resume(connection, *payload.Revision, connection.outbox.replayLimit())
+		return false, stateUpdate{}, err
+	})
+	if err != nil {
+		log.Println("failed to resume: ", err)
+		return connection.sendError(message.ID, errorInternal, "failed to read the state")
+	}
+
+	return connection.send(messageAck, message.ID, resumePayload{status, current})
 }
 
-func (connections *connections) close() {
-	connections.mutex.RLock()
-	defer connections.mutex.RUnlock()
+func (connection *connection) handleMessage(data []byte) error {
+	var message envelope
+	if err := json.Unmarshal(data, &message); err != nil {
+		return connection.reject(
+			"", errorInvalidMessage,
+			"couldn't parse the message as a JSON object",
+			websocket.StatusInvalidFramePayloadData,
+		)
+	}
 
-	for _, userConnections := range connections.dict {
-		for connection := range userConnections {
-			connection.Close(websocket.StatusNormalClosure, "server shutting down")
+	switch message.Type {
+	case messageHello:
+		return connection.handleHello(message)
+	case messagePing:
+		connection.malformedFrames = 0
+		return connection.send(messagePong, message.ID, nil)
+	case messageState:
+		push, revision, err := connection.handleState(string(message.Payload))
+		if err != nil {
+			return connection.rejectState(message.ID, err)
 		}
+		connection.malformedFrames = 0
+		return connection.send(messageAck, message.ID, ackPayload{push, revision})
+	case messagePatch:
+		return connection.handlePatch(message)
+	case messageAction:
+		return connection.handleAction(message)
+	case messageTime:
+		return connection.handleTime(message, connection.receivedAt)
+	default:
+		return connection.reject(
+			message.ID, errorUnknownType,
+			fmt.Sprintf("unknown message type %q", message.Type),
+			websocket.StatusPolicyViolation,
+		)
 	}
 }
 
+func (connection *connection) handleFrame(ctx context.Context) error {
+	messageType, message, err := connection.Read(ctx)
+	if err != nil {
+		var closeError websocket.CloseError
+		if errors.As(err, &closeError) {
+			return fmt.Errorf(
+				"received a close frame from %v (%d, %q)",
+				connection.request.RemoteAddr, closeError.Code, closeError.Reason,
+			)
+		}
+
+		return err
+	}
+	connection.touch()
+	connection.receivedAt = time.Now()
+
+	if messageType != websocket.MessageText {
+		return connection.reject(
+			"", errorUnsupportedData,
+			"only text frames are supported",
+			websocket.StatusPolicyViolation,
+		)
+	}
+
+	if connection.Subprotocol() == protocolV2 {
+		return connection.handleMessage(message)
+	}
+
+	if _, _, err := connection.handleState(string(message)); err != nil {
+		return connection.rejectState("", err)
+	}
+	connection.malformedFrames = 0
+
+	return nil
+}
+
 type wsHandler struct {
-	connections connections
-	waitGroup   sync.WaitGroup
+	config    Config
+	hubs      hubs
+	waitGroup sync.WaitGroup
 }
 
-func newWsHandler() *wsHandler {
+func newWsHandler(config Config) *wsHandler {
 	return &wsHandler{
-		connections: newConnections(),
+		config: config,
+		hubs:   newHubs(config.JournalSize),
 	}
 }
 
-func (handler *wsHandler) handle(userID db.UserID, writer http.ResponseWriter, request *http.Request) error {
+func (handler *wsHandler) handle(subscription subscription, device device, writer http.ResponseWriter, request *http.Request) error {
 	defer handler.waitGroup.Done()
 
 	originHeader := request.Header.Get("Origin")
@@ -139,25 +580,55 @@ func (handler *wsHandler) handle(userID db.UserID, writer http.ResponseWriter, r
 
 	options := websocket.AcceptOptions{
 		OriginPatterns: []string{origin.Hostname()},
-		Subprotocols:   []string{"flowey"},
+		Subprotocols:   []string{protocolV1, protocolV2},
 	}
 	conn, err := websocket.Accept(writer, request, &options)
 	if err != nil {
 		return err
 	}
 
-	connection := connection{conn, writer, request}
+	timerHub := handler.hubs.acquire(subscription.key)
+	defer handler.hubs.release(timerHub)
+
+	connection := newConnection(conn, writer, request, timerHub, subscription, device, handler.config)
 	defer connection.CloseNow()
+	defer timerHub.leave(connection)
+	defer subscription.expire(connection)()
+
+	log.Printf("opened a connection with %v (%s)", request.RemoteAddr, connection.Subprotocol())
 
-	handler.connections.store(userID, &connection)
-	defer handler.connections.delete(userID, &connection)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	log.Printf("opened a connection with %v", request.RemoteAddr)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		connection.writeLoop(ctx, cancel)
+	}()
+	go connection.keepAlive(ctx, handler.config)
+
+	if connection.Subprotocol() == protocolV2 {
+		if err := connection.send(messageHello, "", helloPayload{protocolV2}); err != nil {
+			return err
+		}
+	}
+
+	if revision, err := strconv.ParseInt(request.URL.Query().Get("revision"), 10, 64); err == nil {
+		if _, _, err := timerHub.joinAt(connection, revision, connection.outbox.replayLimit()); err != nil {
+			return err
+		}
+	} else {
+		timerHub.join(connection)
+	}
+	handler.hubs.announce(connection, presenceJoin)
+	defer handler.hubs.announce(connection, presenceLeave)
 
-	ctx := context.Background()
 	for {
-		err := connection.handleFrame(ctx, userID, &handler.connections)
+		err := connection.handleFrame(ctx)
 		if err != nil {
+			if connection.closeRequested.Load() {
+				<-writerDone
+			}
 			return err
 		}
 	}
@@ -166,7 +637,7 @@ func (handler *wsHandler) handle(userID db.UserID, writer http.ResponseWriter, r
 func (handler *wsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	protocolsHeader := request.Header.Get("Sec-WebSocket-Protocol")
 	protocols := strings.Split(protocolsHeader, ", ")
-	if len(protocols) != 2 || protocols[0] != "flowey" {
+	if len(protocols) != 2 || !supportedProtocol(protocols[0]) {
 		writer.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -185,9 +656,22 @@ func (handler *wsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Re
 		return
 	}
 
+	subscription, ok := requestSubscription(writer, request, userID)
+	if !ok {
+		return
+	}
+
+	subscription.session = sessionToken
+
+	device, err := requestDevice(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	handler.waitGroup.Add(1)
 
-	err = handler.handle(userID, writer, request)
+	err = handler.handle(subscription, device, writer, request)
 	if err != nil {
 		log.Println(err)
 		return
@@ -195,6 +679,6 @@ func (handler *wsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Re
 }
 
 func (handler *wsHandler) close() {
-	handler.connections.close()
+	handler.hubs.close()
 	handler.waitGroup.Wait()
 }
@@ -0,0 +1,151 @@
+// Package timer implements the rules of the focus timer: how starting,
+// stopping, reversing, buffs and the maximum time change its state.
+package timer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+var (
+	UnknownAction     = errors.New("unknown action")
+	InvalidTransition = errors.New("invalid transition")
+)
+
+const (
+	MinBuff  = 1.00
+	MaxBuff  = 2.00
+	buffStep = 0.05
+
+	MinMaxTime  = int64(24 * time.Hour / time.Millisecond)
+	MaxMaxTime  = int64(72 * time.Hour / time.Millisecond)
+	maxTimeStep = int64(time.Hour / time.Millisecond)
+
+	// onThreshold is how far from the target date the timer still counts as
+	// running, so that rounding doesn't flip it on and off.
+	onThreshold = 500
+)
+
+type Action string
+
+const (
+	Start      Action = "start"
+	Stop       Action = "stop"
+	Reverse    Action = "reverse"
+	NextBuff   Action = "nextBuff"
+	IncMaxTime Action = "incMaxTime"
+	DecMaxTime Action = "decMaxTime"
+)
+
+// Timer is the part of the state the rules act on. Times are in milliseconds,
+// TargetDate since the Unix epoch.
+type Timer struct {
+	Buff        float64 `json:"buff"`
+	IsReverseOn bool    `json:"isReverseOn"`
+	MaxTime     int64   `json:"maxTime"`
+	TargetDate  float64 `json:"targetDate"`
+}
+
+func New(now int64) Timer {
+	return Timer{
+		Buff:       MinBuff,
+		MaxTime:    MinMaxTime,
+		TargetDate: float64(now),
+	}
+}
+
+// CurrentDifference is the time left until the target date, or the buffed
+// time spent past it as a negative number, capped at the maximum time.
+func (timer Timer) CurrentDifference(now int64) float64 {
+	difference := timer.TargetDate - float64(now)
+	distance := math.Abs(difference)
+	if difference < 0 {
+		distance *= timer.Buff
+	}
+
+	sign := 0.0
+	if difference > 0 {
+		sign = 1
+	} else if difference < 0 {
+		sign = -1
+	}
+
+	return sign * math.Min(distance, float64(timer.MaxTime))
+}
+
+func (timer Timer) IsOn(now int64) bool {
+	return timer.IsReverseOn || timer.CurrentDifference(now) > onThreshold
+}
+
+// FinishesAt is when a running timer stops counting by itself: when it
+// reaches zero or, reversed, when the buffed time spent reaches the maximum
+// time. It's in milliseconds since the Unix epoch.
+func (timer Timer) FinishesAt() float64 {
+	if timer.IsReverseOn {
+		return timer.TargetDate + float64(timer.MaxTime)/timer.Buff
+	}
+	return timer.TargetDate - onThreshold
+}
+
+// Apply returns the timer after the action happened at now.
+func (timer Timer) Apply(action Action, now int64) (Timer, error) {
+	switch action {
+	case Start:
+		if timer.IsOn(now) {
+			return timer, fmt.Errorf("%w: the timer is already running", InvalidTransition)
+		}
+		timer.TargetDate = float64(now + timer.MaxTime)
+	case Stop:
+		if !timer.IsOn(now) {
+			return timer, fmt.Errorf("%w: the timer isn't running", InvalidTransition)
+		}
+		timer.IsReverseOn = false
+		timer.TargetDate = float64(now)
+	case Reverse:
+		if !timer.IsOn(now) {
+			return timer, fmt.Errorf("%w: the timer isn't running", InvalidTransition)
+		}
+		difference := timer.CurrentDifference(now)
+		if difference > 0 {
+			difference /= timer.Buff
+		}
+		timer.TargetDate = float64(now) - difference
+		timer.IsReverseOn = !timer.IsReverseOn
+	case NextBuff:
+		timer = timer.nextBuff(now)
+	case IncMaxTime:
+		if timer.IsOn(now) {
+			return timer, fmt.Errorf("%w: the timer is running", InvalidTransition)
+		}
+		timer.MaxTime = min(MaxMaxTime, timer.MaxTime+maxTimeStep)
+	case DecMaxTime:
+		if timer.IsOn(now) {
+			return timer, fmt.Errorf("%w: the timer is running", InvalidTransition)
+		}
+		timer.MaxTime = max(MinMaxTime, timer.MaxTime-maxTimeStep)
+	default:
+		return timer, fmt.Errorf("%w %q", UnknownAction, action)
+	}
+
+	return timer, nil
+}
+
+// nextBuff steps the buff and, if the target date has passed, moves it so
+// that the buffed time spent past it stays the same.
+func (timer Timer) nextBuff(now int64) Timer {
+	prevBuff := timer.Buff
+	timer.Buff = math.Round((timer.Buff+buffStep)*100) / 100
+	if timer.Buff > MaxBuff {
+		timer.Buff = MinBuff
+	}
+
+	difference := timer.TargetDate - float64(now)
+	if difference < 0 {
+		distance := math.Abs(difference) * prevBuff / timer.Buff
+		timer.TargetDate = float64(now) - distance
+	}
+
+	return timer
+}
@@ -0,0 +1,324 @@
+// Package webpush sends Web Push messages: payloads encrypted for the
+// browser as in RFC 8291 and authorized with a VAPID token as in RFC 8292.
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	InvalidKey          = errors.New("invalid key")
+	InvalidSubscription = errors.New("invalid push subscription")
+	PayloadTooLarge     = errors.New("the payload is too large")
+	// Gone means the push service no longer knows the subscription, so it
+	// should be forgotten.
+	Gone = errors.New("the push subscription has expired or was unsubscribed")
+)
+
+const (
+	// recordSize is the size of the single aes128gcm record a message is
+	// sent in. Push services must accept at least 4096 bytes.
+	recordSize = 4096
+	// MaxPayloadSize is the largest payload that fits in the record with
+	// its delimiter and tag.
+	MaxPayloadSize = recordSize - 1 - 16 - headerSize
+	headerSize     = 16 + 4 + 1 + 65
+
+	tokenLifetime = 12 * time.Hour
+)
+
+// VAPID identifies the application server to push services.
+type VAPID struct {
+	PrivateKey *ecdsa.PrivateKey
+	// Subject is a mailto: or https: URL push services can reach the
+	// operator at.
+	Subject string
+}
+
+// GenerateKey returns a new P-256 VAPID private key.
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// MarshalKey encodes a private key as base64 PKCS #8, for storage.
+func MarshalKey(key *ecdsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// ParseKey decodes a private key encoded by MarshalKey.
+func ParseKey(encoded string) (*ecdsa.PrivateKey, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidKey, err)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidKey, err)
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecdsaKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("%w: not a P-256 key", InvalidKey)
+	}
+	return ecdsaKey, nil
+}
+
+// PublicKey returns the uncompressed public key in base64url, as browsers
+// take it for applicationServerKey.
+func PublicKey(key *ecdsa.PrivateKey) (string, error) {
+	public, err := key.PublicKey.ECDH()
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(public.Bytes()), nil
+}
+
+// Subscription is what a browser's PushSubscription carries: where to send
+// messages and the keys to encrypt them with, in base64url.
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// decodeBase64 accepts base64url with or without padding, as browsers and
+// libraries disagree on it.
+func decodeBase64(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// Validate checks that the endpoint is an https URL, as RFC 8030 requires,
+// and that the keys are a P-256 public key and a 16 byte authentication
+// secret.
+func (subscription Subscription) Validate() error {
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return fmt.Errorf("%w: the endpoint must be an absolute https url", InvalidSubscription)
+	}
+
+	public, err := decodeBase64(subscription.Keys.P256dh)
+	if err == nil {
+		_, err = ecdh.P256().NewPublicKey(public)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: p256dh isn't a P-256 public key", InvalidSubscription)
+	}
+
+	auth, err := decodeBase64(subscription.Keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return fmt.Errorf("%w: auth isn't a 16 byte secret", InvalidSubscription)
+	}
+
+	return nil
+}
+
+func hkdfExpand(secret, salt, info []byte, size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encrypt encrypts a payload for a subscription with a fresh key and salt,
+// as a single aes128gcm record (RFC 8188) keyed as in RFC 8291.
+func Encrypt(subscription Subscription, payload []byte) ([]byte, error) {
+	serverKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return encrypt(subscription, payload, serverKey, salt)
+}
+
+// encrypt is Encrypt with a given key and salt.
+func encrypt(subscription Subscription, payload []byte, serverKey *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	if len(payload) > MaxPayloadSize {
+		return nil, PayloadTooLarge
+	}
+
+	userAgentBytes, err := decodeBase64(subscription.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidSubscription, err)
+	}
+	userAgentKey, err := ecdh.P256().NewPublicKey(userAgentBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidSubscription, err)
+	}
+	authSecret, err := decodeBase64(subscription.Keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidSubscription, err)
+	}
+
+	serverBytes := serverKey.PublicKey().Bytes()
+
+	sharedSecret, err := serverKey.ECDH(userAgentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), userAgentBytes...)
+	keyInfo = append(keyInfo, serverBytes...)
+	inputKey, err := hkdfExpand(sharedSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	contentKey, err := hkdfExpand(inputKey, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdfExpand(inputKey, salt, []byte("Content-Encoding: nonce\x00"), 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(recordSize))
+	body.WriteByte(byte(len(serverBytes)))
+	body.Write(serverBytes)
+
+	// The last record ends with the delimiter 2 and needs no padding.
+	plaintext := append(append([]byte{}, payload...), 2)
+	body.Write(gcm.Seal(nil, nonce, plaintext, nil))
+
+	return body.Bytes(), nil
+}
+
+// Authorization returns the VAPID Authorization header for an endpoint: a
+// JWT signed with ES256 for the endpoint's origin, and the public key.
+func (vapid VAPID) Authorization(endpoint string, now time.Time) (string, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", InvalidSubscription, err)
+	}
+
+	header, err := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"aud": endpointURL.Scheme + "://" + endpointURL.Host,
+		"exp": now.Add(tokenLifetime).Unix(),
+		"sub": vapid.Subject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, vapid.PrivateKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	publicKey, err := PublicKey(vapid.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	token := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return fmt.Sprintf("vapid t=%s, k=%s", token, publicKey), nil
+}
+
+// Message is a push message and how the push service should treat it.
+type Message struct {
+	Payload []byte
+	// TTL is how long the push service keeps the message for an offline
+	// browser.
+	TTL     time.Duration
+	Urgency string
+	Topic   string
+}
+
+// Send encrypts and posts a message to a subscription's push service. It
+// returns Gone if the service no longer knows the subscription.
+func (vapid VAPID) Send(ctx context.Context, client *http.Client, subscription Subscription, message Message) error {
+	body, err := Encrypt(subscription, message.Payload)
+	if err != nil {
+		return err
+	}
+
+	authorization, err := vapid.Authorization(subscription.Endpoint, time.Now())
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", authorization)
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("TTL", strconv.Itoa(int(message.TTL/time.Second)))
+	if message.Urgency != "" {
+		request.Header.Set("Urgency", message.Urgency)
+	}
+	if message.Topic != "" {
+		request.Header.Set("Topic", message.Topic)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	switch {
+	case response.StatusCode == http.StatusNotFound, response.StatusCode == http.StatusGone:
+		return Gone
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return fmt.Errorf("the push service answered %s", response.Status)
+	}
+	return nil
+}
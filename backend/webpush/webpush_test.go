@@ -0,0 +1,92 @@
+package webpush
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func decodeTestBase64(t *testing.T, value string) []byte {
+	t.Helper()
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+// TestEncrypt checks Encrypt against the example of RFC 8291, Appendix A.
+func TestEncrypt(t *testing.T) {
+	var subscription Subscription
+	subscription.Endpoint = "https://push.example.net/push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV"
+	subscription.Keys.P256dh = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	subscription.Keys.Auth = "BTBZMqHH6r4Tts7J_aSIgg"
+	if err := subscription.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	serverKey, err := ecdh.P256().NewPrivateKey(decodeTestBase64(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := decodeTestBase64(t, "DGv6ra1nlYgDCS1FRnbzlw")
+
+	body, err := encrypt(subscription, []byte("When I grow up, I want to be a watermelon"), serverKey, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if got := base64.RawURLEncoding.EncodeToString(body); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var subscription Subscription
+	subscription.Endpoint = "http://push.example.net/push/1"
+	subscription.Keys.P256dh = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	subscription.Keys.Auth = "BTBZMqHH6r4Tts7J_aSIgg"
+	if err := subscription.Validate(); !errors.Is(err, InvalidSubscription) {
+		t.Errorf("got %v for an http endpoint, want %v", err, InvalidSubscription)
+	}
+}
+
+func TestSendGone(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vapid := VAPID{PrivateKey: key, Subject: "mailto:ops@example.org"}
+
+	for _, test := range []struct {
+		status int
+		want   error
+	}{
+		{http.StatusCreated, nil},
+		{http.StatusNotFound, Gone},
+		{http.StatusGone, Gone},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if request.Header.Get("Content-Encoding") != "aes128gcm" {
+				t.Errorf("got Content-Encoding %q", request.Header.Get("Content-Encoding"))
+			}
+			writer.WriteHeader(test.status)
+		}))
+
+		var subscription Subscription
+		subscription.Endpoint = server.URL + "/push/1"
+		subscription.Keys.P256dh = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+		subscription.Keys.Auth = "BTBZMqHH6r4Tts7J_aSIgg"
+
+		err := vapid.Send(context.Background(), server.Client(), subscription, Message{Payload: []byte("{}")})
+		if !errors.Is(err, test.want) {
+			t.Errorf("got %v for status %d, want %v", err, test.status, test.want)
+		}
+		server.Close()
+	}
+}